@@ -0,0 +1,135 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+const (
+	deltaTemporality      = "delta"
+	cumulativeTemporality = "cumulative"
+)
+
+// MetricsAggregator accumulates metrics over an aggregation interval.
+// With delta temporality, the metrics are reset every time they are flushed.
+// With cumulative temporality, they keep accumulating from the time each
+// series was first seen, until the series is not recorded for the series TTL.
+type MetricsAggregator struct {
+	temporality pmetric.AggregationTemporality
+	seriesTTL   time.Duration
+	metrics     Metrics
+	windowStart pcommon.Timestamp
+}
+
+func NewMetricsAggregator(temporality string, seriesTTL time.Duration, start time.Time) *MetricsAggregator {
+	aggregator := &MetricsAggregator{
+		temporality: pmetric.AggregationTemporalityDelta,
+		seriesTTL:   seriesTTL,
+		metrics:     NewMetrics(),
+		windowStart: pcommon.NewTimestampFromTime(start),
+	}
+	if temporality == cumulativeTemporality {
+		aggregator.temporality = pmetric.AggregationTemporalityCumulative
+	}
+	return aggregator
+}
+
+// Metrics returns the metrics being aggregated in the current interval.
+func (aggregator *MetricsAggregator) Metrics() Metrics {
+	return aggregator.metrics
+}
+
+// Flush converts the aggregated metrics into OTEL metrics covering the interval ending now.
+func (aggregator *MetricsAggregator) Flush(now time.Time) pmetric.Metrics {
+	timestamp := pcommon.NewTimestampFromTime(now)
+	if aggregator.temporality == pmetric.AggregationTemporalityCumulative {
+		aggregator.evictExpiredSeries(now)
+	}
+	for _, rm := range aggregator.metrics {
+		for _, sm := range rm.scopeMetrics {
+			for _, m := range sm.metrics {
+				for _, dp := range m.histogramDatapoints {
+					dp.startTimestamp, dp.timestamp = aggregator.getTimestamps(&dp.seriesStart, timestamp)
+				}
+				for _, dp := range m.sumDatapoints {
+					dp.startTimestamp, dp.timestamp = aggregator.getTimestamps(&dp.seriesStart, timestamp)
+				}
+			}
+		}
+	}
+
+	otelMetrics := aggregator.metrics.appendOtelMetrics(pmetric.NewMetrics(), aggregator.temporality)
+
+	if aggregator.temporality == pmetric.AggregationTemporalityDelta {
+		aggregator.metrics = NewMetrics()
+	} else {
+		// gauges are only reported for the interval in which they were set
+		for _, rm := range aggregator.metrics {
+			for _, sm := range rm.scopeMetrics {
+				for metricName, m := range sm.metrics {
+					m.gaugeDatapoints = make(map[string]*GaugeDatapoint)
+					if len(m.histogramDatapoints)+len(m.sumDatapoints) == 0 {
+						delete(sm.metrics, metricName)
+					}
+				}
+			}
+		}
+	}
+	aggregator.windowStart = timestamp
+
+	return otelMetrics
+}
+
+// evictExpiredSeries forgets the cumulative series that were not recorded for the series TTL, as the cardinality
+// limits do, so that the number of series reported does not keep growing.
+func (aggregator *MetricsAggregator) evictExpiredSeries(now time.Time) {
+	for resourceKey, rm := range aggregator.metrics {
+		metricCount := 0
+		for _, sm := range rm.scopeMetrics {
+			for metricName, m := range sm.metrics {
+				for key, dp := range m.histogramDatapoints {
+					if aggregator.isExpired(&dp.updated, &dp.lastSeen, now) {
+						delete(m.histogramDatapoints, key)
+					}
+				}
+				for key, dp := range m.sumDatapoints {
+					if aggregator.isExpired(&dp.updated, &dp.lastSeen, now) {
+						delete(m.sumDatapoints, key)
+					}
+				}
+				if len(m.histogramDatapoints)+len(m.sumDatapoints)+len(m.gaugeDatapoints) == 0 {
+					delete(sm.metrics, metricName)
+				}
+			}
+			metricCount += len(sm.metrics)
+		}
+		if metricCount == 0 {
+			delete(aggregator.metrics, resourceKey)
+		}
+	}
+}
+
+// isExpired records when a series was last recorded and returns true when it was not for the series TTL.
+func (aggregator *MetricsAggregator) isExpired(updated *bool, lastSeen *time.Time, now time.Time) bool {
+	if *updated {
+		*updated = false
+		*lastSeen = now
+		return false
+	}
+	return now.Sub(*lastSeen) >= aggregator.seriesTTL
+}
+
+func (aggregator *MetricsAggregator) getTimestamps(seriesStart *pcommon.Timestamp, timestamp pcommon.Timestamp) (pcommon.Timestamp, pcommon.Timestamp) {
+	if aggregator.temporality == pmetric.AggregationTemporalityDelta {
+		return aggregator.windowStart, timestamp
+	}
+	if *seriesStart == 0 {
+		*seriesStart = aggregator.windowStart
+	}
+	return *seriesStart, timestamp
+}
@@ -0,0 +1,126 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+)
+
+func TestDeltaAggregation(t *testing.T) {
+	start := time.Unix(1000, 0)
+	aggregator := NewMetricsAggregator(deltaTemporality, defaultSeriesTTL, start)
+
+	addTestDatapoints(aggregator, start)
+	addTestDatapoints(aggregator, start.Add(time.Second))
+
+	metrics := aggregator.Flush(start.Add(time.Minute))
+	assert.Equal(t, 2, metrics.MetricCount())
+	sm := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0)
+	histogram := findMetric(t, "apm.service.transaction.sampled_duration", sm.Metrics()).ExponentialHistogram()
+	assert.Equal(t, pmetric.AggregationTemporalityDelta, histogram.AggregationTemporality())
+	assert.Equal(t, uint64(2), histogram.DataPoints().At(0).Count())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start), histogram.DataPoints().At(0).StartTimestamp())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(time.Minute)), histogram.DataPoints().At(0).Timestamp())
+	sum := findMetric(t, "apm.service.error.count", sm.Metrics()).Sum()
+	assert.Equal(t, pmetric.AggregationTemporalityDelta, sum.AggregationTemporality())
+	assert.Equal(t, int64(2), sum.DataPoints().At(0).IntValue())
+
+	addTestDatapoints(aggregator, start.Add(time.Minute))
+	metrics = aggregator.Flush(start.Add(2 * time.Minute))
+	sm = metrics.ResourceMetrics().At(0).ScopeMetrics().At(0)
+	histogram = findMetric(t, "apm.service.transaction.sampled_duration", sm.Metrics()).ExponentialHistogram()
+	assert.Equal(t, uint64(1), histogram.DataPoints().At(0).Count())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(time.Minute)), histogram.DataPoints().At(0).StartTimestamp())
+
+	assert.Equal(t, 0, aggregator.Flush(start.Add(3*time.Minute)).MetricCount())
+}
+
+func TestCumulativeAggregation(t *testing.T) {
+	start := time.Unix(1000, 0)
+	aggregator := NewMetricsAggregator(cumulativeTemporality, defaultSeriesTTL, start)
+
+	addTestDatapoints(aggregator, start)
+	aggregator.Flush(start.Add(time.Minute))
+
+	addTestDatapoints(aggregator, start.Add(-time.Hour))
+	metrics := aggregator.Flush(start.Add(2 * time.Minute))
+	sm := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0)
+	histogram := findMetric(t, "apm.service.transaction.sampled_duration", sm.Metrics()).ExponentialHistogram()
+	assert.Equal(t, pmetric.AggregationTemporalityCumulative, histogram.AggregationTemporality())
+	assert.Equal(t, uint64(2), histogram.DataPoints().At(0).Count())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start), histogram.DataPoints().At(0).StartTimestamp())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(2*time.Minute)), histogram.DataPoints().At(0).Timestamp())
+	sum := findMetric(t, "apm.service.error.count", sm.Metrics()).Sum()
+	assert.Equal(t, pmetric.AggregationTemporalityCumulative, sum.AggregationTemporality())
+	assert.Equal(t, int64(2), sum.DataPoints().At(0).IntValue())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start), sum.DataPoints().At(0).StartTimestamp())
+}
+
+func TestCumulativeAggregationSeriesTTL(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := start
+	limits := NewCardinalityLimits(CardinalityLimitsConfig{MaxSeriesPerMetric: 1, SeriesTTL: 10 * time.Minute})
+	limits.now = func() time.Time { return now }
+	aggregator := NewMetricsAggregator(cumulativeTemporality, 10*time.Minute, start)
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("service.name", "service")
+	addTransaction := func(name string) {
+		metrics := aggregator.Metrics()
+		attributes := pcommon.NewMap()
+		attributes.PutStr("transactionName", name)
+		timestamp := pcommon.NewTimestampFromTime(now)
+		metrics.GetOrCreateLimitedResource(resourceAttributes, limits).AddHistogram("apm.service.transaction.sampled_duration", attributes, timestamp, timestamp, int64(time.Second))
+	}
+	getTransactionNames := func(metrics pmetric.Metrics) []string {
+		var names []string
+		dps := findMetric(t, "apm.service.transaction.sampled_duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+		for i := 0; i < dps.Len(); i++ {
+			name, _ := dps.At(i).Attributes().Get("transactionName")
+			names = append(names, name.Str())
+		}
+		return names
+	}
+
+	addTransaction("WebTransaction/Other/first")
+	assert.Equal(t, []string{"WebTransaction/Other/first"}, getTransactionNames(aggregator.Flush(now)))
+	now = start.Add(5 * time.Minute)
+	assert.Equal(t, []string{"WebTransaction/Other/first"}, getTransactionNames(aggregator.Flush(now)))
+
+	// the series is no longer reported once the cardinality limits forget it, and a new one takes its place
+	now = start.Add(11 * time.Minute)
+	addTransaction("WebTransaction/Other/second")
+	assert.Equal(t, []string{"WebTransaction/Other/second"}, getTransactionNames(aggregator.Flush(now)))
+	now = start.Add(30 * time.Minute)
+	assert.Equal(t, 0, aggregator.Flush(now).MetricCount())
+}
+
+func addTestDatapoints(aggregator *MetricsAggregator, timestamp time.Time) {
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("service.name", "service")
+	metrics := aggregator.Metrics()
+	resourceMetrics := metrics.GetOrCreateResource(resourceAttributes)
+
+	start := pcommon.NewTimestampFromTime(timestamp)
+	end := pcommon.NewTimestampFromTime(timestamp.Add(time.Second))
+	attributes := pcommon.NewMap()
+	attributes.PutStr("transactionName", "WebTransaction/Other/test")
+	resourceMetrics.AddHistogram("apm.service.transaction.sampled_duration", attributes, start, end, int64(time.Second))
+	resourceMetrics.GetSum("apm.service.error.count", pcommon.NewMap(), true, start, end).Add(1, start, end)
+}
+
+func findMetric(t *testing.T, name string, metrics pmetric.MetricSlice) pmetric.Metric {
+	t.Helper()
+	for i := 0; i < metrics.Len(); i++ {
+		if metrics.At(i).Name() == name {
+			return metrics.At(i)
+		}
+	}
+	assert.Fail(t, "Could not find metric "+name)
+	return pmetric.NewMetric()
+}
@@ -0,0 +1,56 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import "strings"
+
+// ApdexRules resolves the Apdex to use for a given service and transaction.
+// The first override matching both the service and the transaction wins,
+// the default Apdex is used when none matches.
+type ApdexRules struct {
+	defaultApdex Apdex
+	overrides    []ApdexTOverride
+}
+
+func NewApdexRules(apdexT float64, overrides []ApdexTOverride) ApdexRules {
+	return ApdexRules{defaultApdex: NewApdex(apdexT), overrides: overrides}
+}
+
+func (rules ApdexRules) GetApdex(serviceName string, transactionName string) Apdex {
+	for _, override := range rules.overrides {
+		if override.matches(serviceName, transactionName) {
+			return NewApdex(override.ApdexT)
+		}
+	}
+	return rules.defaultApdex
+}
+
+func (override ApdexTOverride) matches(serviceName string, transactionName string) bool {
+	if override.ServiceName != "" && !MatchGlob(override.ServiceName, serviceName) {
+		return false
+	}
+	return override.TransactionName == "" || MatchGlob(override.TransactionName, transactionName)
+}
+
+// MatchGlob reports whether the name matches the pattern, where `*` matches
+// any sequence of characters, including `/`. All the options accepting glob
+// patterns use it.
+func MatchGlob(pattern string, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
@@ -0,0 +1,35 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApdexRules(t *testing.T) {
+	rules := NewApdexRules(0.5, []ApdexTOverride{
+		{ServiceName: "checkout", TransactionName: "WebTransaction/http.route/api/cart*", ApdexT: 0.05},
+		{TransactionName: "WebTransaction/http.route/api/search*", ApdexT: 2},
+		{ServiceName: "checkout", ApdexT: 0.1},
+	})
+
+	assert.Equal(t, NewApdex(0.05), rules.GetApdex("checkout", "WebTransaction/http.route/api/cart/{id} (GET)"))
+	assert.Equal(t, NewApdex(2), rules.GetApdex("checkout", "WebTransaction/http.route/api/search (GET)"))
+	assert.Equal(t, NewApdex(2), rules.GetApdex("catalog", "WebTransaction/http.route/api/search/{term} (GET)"))
+	assert.Equal(t, NewApdex(0.1), rules.GetApdex("checkout", "WebTransaction/http.route/api/orders (POST)"))
+	assert.Equal(t, NewApdex(0.5), rules.GetApdex("catalog", "WebTransaction/http.route/api/products (GET)"))
+}
+
+func TestMatchGlob(t *testing.T) {
+	assert.True(t, MatchGlob("checkout", "checkout"))
+	assert.False(t, MatchGlob("checkout", "checkout-api"))
+	assert.True(t, MatchGlob("checkout*", "checkout-api"))
+	assert.True(t, MatchGlob("*/api/*", "WebTransaction/http.route/api/search (GET)"))
+	assert.True(t, MatchGlob("*", ""))
+	assert.True(t, MatchGlob("a*b*c", "abbc"))
+	assert.False(t, MatchGlob("a*b*c", "acb"))
+	assert.False(t, MatchGlob("ab*ba", "aba"))
+}
@@ -7,35 +7,68 @@ import (
 	"go.opentelemetry.io/collector/pdata/pcommon"
 )
 
+var defaultResourceAttributes = []string{"instrumentation.provider", "os.description", "telemetry.auto.version", "telemetry.sdk.language", "host.name",
+	"os.type", "telemetry.sdk.name", "process.runtime.description", "process.runtime.version", "telemetry.sdk.version",
+	"host.arch", "service.name", "service.instance.id", "service.namespace", "container.id"}
+
 type AttributeFilter struct {
 	attributesToKeep []string
+	// glob patterns of the attributes to keep in addition to attributesToKeep
+	include []string
+	// glob patterns of the attributes to drop, takes precedence over everything else
+	exclude []string
 }
 
-func NewAttributeFilter() *AttributeFilter {
-	return &AttributeFilter{attributesToKeep: []string{"instrumentation.provider", "os.description", "telemetry.auto.version", "telemetry.sdk.language", "host.name",
-		"os.type", "telemetry.sdk.name", "process.runtime.description", "process.runtime.version", "telemetry.sdk.version",
-		"host.arch", "service.name", "service.instance.id"}}
+// NewAttributeFilter creates a filter keeping the default resource attributes, the ones matching
+// one of the include patterns and dropping the ones matching one of the exclude patterns.
+// Patterns follow the syntax of MatchGlob, for example `k8s.*`.
+func NewAttributeFilter(include []string, exclude []string) *AttributeFilter {
+	return &AttributeFilter{attributesToKeep: defaultResourceAttributes, include: include, exclude: exclude}
 }
 
 func (attributeFilter *AttributeFilter) FilterAttributes(from pcommon.Map) (pcommon.Map, error) {
-	f := from.AsRaw()
-	m := make(map[string]any)
-	for _, k := range attributeFilter.attributesToKeep {
-		if v, exists := f[k]; exists {
-			m[k] = v
-		}
-	}
 	newMap := pcommon.NewMap()
-	err := newMap.FromRaw(m)
-	if err != nil {
-		return newMap, nil
-	}
-	if hostName, exists := from.Get("host.name"); exists {
-		newMap.PutStr("host", hostName.AsString())
+	from.Range(func(k string, v pcommon.Value) bool {
+		if attributeFilter.shouldKeep(k) {
+			v.CopyTo(newMap.PutEmpty(k))
+		}
+		return true
+	})
+	// the attributes derived from host.name are excluded like the other ones
+	if hostName, exists := newMap.Get("host.name"); exists {
+		if !attributeFilter.isExcluded("host") {
+			newMap.PutStr("host", hostName.AsString())
+		}
 
-		if _, e := newMap.Get("service.instance.id"); !e {
+		if _, e := newMap.Get("service.instance.id"); !e && !attributeFilter.isExcluded("service.instance.id") {
 			newMap.PutStr("service.instance.id", hostName.AsString())
 		}
 	}
 	return newMap, nil
 }
+
+func (attributeFilter *AttributeFilter) shouldKeep(key string) bool {
+	if attributeFilter.isExcluded(key) {
+		return false
+	}
+	for _, k := range attributeFilter.attributesToKeep {
+		if k == key {
+			return true
+		}
+	}
+	return matchesAny(attributeFilter.include, key)
+}
+
+// isExcluded returns true when the attribute matches one of the exclude patterns.
+func (attributeFilter *AttributeFilter) isExcluded(key string) bool {
+	return matchesAny(attributeFilter.exclude, key)
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if MatchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -17,7 +17,7 @@ func TestFilterAttributes(t *testing.T) {
 	m.PutStr("host.name", "loki")
 	m.PutStr("stuff", "meh")
 	m.PutDouble("process.pid", 1)
-	filtered, err := NewAttributeFilter().FilterAttributes(m)
+	filtered, err := NewAttributeFilter(nil, nil).FilterAttributes(m)
 
 	assert.Nil(t, err)
 	assert.Equal(t, 5, len(filtered.AsRaw()))
@@ -44,7 +44,7 @@ func TestFilterAttributesInstancePresent(t *testing.T) {
 	m.PutStr("host.name", "loki")
 	m.PutStr("service.instance.id", "839944")
 	m.PutDouble("process.pid", 1)
-	filtered, err := NewAttributeFilter().FilterAttributes(m)
+	filtered, err := NewAttributeFilter(nil, nil).FilterAttributes(m)
 
 	assert.Nil(t, err)
 	assert.Equal(t, 4, len(filtered.AsRaw()))
@@ -54,3 +54,46 @@ func TestFilterAttributesInstancePresent(t *testing.T) {
 		assert.Equal(t, "839944", instanceID.AsString())
 	}
 }
+
+func TestFilterAttributesIncludeExclude(t *testing.T) {
+	m := pcommon.NewMap()
+	m.PutStr("service.name", "MyApp")
+	m.PutStr("service.namespace", "shop")
+	m.PutStr("os.type", "linux")
+	m.PutStr("k8s.cluster.name", "production")
+	m.PutStr("k8s.deployment.name", "checkout")
+	m.PutStr("cloud.region", "us-east-1")
+	m.PutStr("cloud.provider", "aws")
+	m.PutInt("process.pid", 1)
+	filtered, err := NewAttributeFilter([]string{"k8s.*", "cloud.region"}, []string{"os.*"}).FilterAttributes(m)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{
+		"service.name":        "MyApp",
+		"service.namespace":   "shop",
+		"k8s.cluster.name":    "production",
+		"k8s.deployment.name": "checkout",
+		"cloud.region":        "us-east-1",
+	}, filtered.AsRaw())
+}
+
+func TestFilterAttributesExcludeHost(t *testing.T) {
+	m := pcommon.NewMap()
+	m.PutStr("service.name", "MyApp")
+	m.PutStr("host.name", "loki")
+	filtered, err := NewAttributeFilter(nil, []string{"host.name"}).FilterAttributes(m)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"service.name": "MyApp"}, filtered.AsRaw())
+}
+
+func TestFilterAttributesExcludeInstanceID(t *testing.T) {
+	m := pcommon.NewMap()
+	m.PutStr("service.name", "MyApp")
+	m.PutStr("service.instance.id", "MyApp-1")
+	m.PutStr("host.name", "loki")
+	filtered, err := NewAttributeFilter(nil, []string{"service.instance.id"}).FilterAttributes(m)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"service.name": "MyApp", "host.name": "loki", "host": "loki"}, filtered.AsRaw())
+}
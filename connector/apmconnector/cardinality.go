@@ -0,0 +1,189 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+const (
+	overflowValue           = "__overflow__"
+	overflowCountMetricName = "apm.service.cardinality.overflow.count"
+
+	defaultSeriesTTL = time.Hour
+	// how often series are checked for expiration, at most
+	seriesEvictionInterval = time.Minute
+)
+
+// attributes replaced with an overflow value once a metric has reached its maximum number of series
+var highCardinalityAttributes = []string{"transactionName", "scope", "metricTimesliceName", DbSQLTableAttributeName,
+	"server.address", "external.host", "net.peer.name", MessagingDestinationNameAttributeName, ErrorClassAttributeName,
+	CalleeServiceAttributeName}
+
+// CardinalityLimits bounds the number of series of each metric of a resource. Once a metric has reached its limit,
+// measurements of new series are recorded in an overflow series, where high cardinality attributes such as the
+// transaction name are replaced with an overflow value. The series are known across batches and aggregation
+// intervals, series not seen for the TTL are forgotten and no longer count towards the limit.
+type CardinalityLimits struct {
+	maxSeriesPerMetric int
+	metrics            map[string]int
+	seriesTTL          time.Duration
+	now                func() time.Time
+
+	lock sync.Mutex
+	// when each series was last seen, by resource and metric
+	series map[string]map[string]map[string]time.Time
+	// when each error class was last seen, by service
+	errorClasses map[string]map[string]time.Time
+	lastEviction time.Time
+}
+
+func NewCardinalityLimits(config CardinalityLimitsConfig) *CardinalityLimits {
+	return &CardinalityLimits{maxSeriesPerMetric: config.MaxSeriesPerMetric, metrics: config.Metrics, seriesTTL: config.getSeriesTTL(),
+		now: time.Now, series: make(map[string]map[string]map[string]time.Time), errorClasses: make(map[string]map[string]time.Time)}
+}
+
+// getMaxSeries returns the maximum number of series of a metric, or 0 when it is not limited.
+func (limits *CardinalityLimits) getMaxSeries(metricName string) int {
+	if maxSeries, exists := limits.metrics[metricName]; exists {
+		return maxSeries
+	}
+	return limits.maxSeriesPerMetric
+}
+
+// admit returns true when the series of a metric of a resource can be recorded: it is already known, or the
+// metric has fewer series than its limit.
+func (limits *CardinalityLimits) admit(resourceKey string, metricName string, seriesKey string) bool {
+	maxSeries := limits.getMaxSeries(metricName)
+	if maxSeries <= 0 {
+		return true
+	}
+
+	limits.lock.Lock()
+	defer limits.lock.Unlock()
+	now := limits.now()
+	limits.evictExpiredSeries(now)
+	metrics, exists := limits.series[resourceKey]
+	if !exists {
+		metrics = make(map[string]map[string]time.Time)
+		limits.series[resourceKey] = metrics
+	}
+	series, exists := metrics[metricName]
+	if !exists {
+		series = make(map[string]time.Time)
+		metrics[metricName] = series
+	}
+	return admitValue(series, seriesKey, maxSeries, now)
+}
+
+// admitErrorClass returns true when the error class of a service can be recorded: it is already known, or the
+// service has fewer error classes than maxClasses. Error classes are known across batches like series.
+func (limits *CardinalityLimits) admitErrorClass(serviceName string, errorClass string, maxClasses int) bool {
+	if maxClasses <= 0 {
+		return true
+	}
+
+	limits.lock.Lock()
+	defer limits.lock.Unlock()
+	now := limits.now()
+	limits.evictExpiredSeries(now)
+	errorClasses, exists := limits.errorClasses[serviceName]
+	if !exists {
+		errorClasses = make(map[string]time.Time)
+		limits.errorClasses[serviceName] = errorClasses
+	}
+	return admitValue(errorClasses, errorClass, maxClasses, now)
+}
+
+// admitValue records when the value was seen and returns true when it is already known or fewer than maxValues values
+// are known.
+func admitValue(lastSeen map[string]time.Time, value string, maxValues int, now time.Time) bool {
+	if _, known := lastSeen[value]; known || len(lastSeen) < maxValues {
+		lastSeen[value] = now
+		return true
+	}
+	return false
+}
+
+// evictExpiredSeries forgets the series and error classes that were not seen for the TTL.
+func (limits *CardinalityLimits) evictExpiredSeries(now time.Time) {
+	if now.Sub(limits.lastEviction) < seriesEvictionInterval && now.Sub(limits.lastEviction) < limits.seriesTTL {
+		return
+	}
+	limits.lastEviction = now
+	for resourceKey, metrics := range limits.series {
+		for metricName, series := range metrics {
+			limits.evictExpiredValues(series, now)
+			if len(series) == 0 {
+				delete(metrics, metricName)
+			}
+		}
+		if len(metrics) == 0 {
+			delete(limits.series, resourceKey)
+		}
+	}
+	for serviceName, errorClasses := range limits.errorClasses {
+		limits.evictExpiredValues(errorClasses, now)
+		if len(errorClasses) == 0 {
+			delete(limits.errorClasses, serviceName)
+		}
+	}
+}
+
+func (limits *CardinalityLimits) evictExpiredValues(lastSeen map[string]time.Time, now time.Time) {
+	for value, seenAt := range lastSeen {
+		if now.Sub(seenAt) >= limits.seriesTTL {
+			delete(lastSeen, value)
+		}
+	}
+}
+
+// limitAttributes returns the attributes of the series a measurement of a metric is recorded in: the given ones,
+// or the overflow ones when the series would exceed the limit of the metric. Measurements recorded in the overflow
+// series are counted.
+func (rm *ResourceMetrics) limitAttributes(metricName string, attributes pcommon.Map, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) pcommon.Map {
+	if rm.limits == nil || metricName == overflowCountMetricName || rm.limits.admit(rm.key, metricName, getKeyFromMap(attributes)) {
+		return attributes
+	}
+
+	counterAttributes := pcommon.NewMap()
+	counterAttributes.PutStr("metricName", metricName)
+	rm.GetSum(overflowCountMetricName, counterAttributes, true, startTimestamp, endTimestamp).Add(1, startTimestamp, endTimestamp)
+
+	return getOverflowAttributes(attributes)
+}
+
+func getOverflowAttributes(attributes pcommon.Map) pcommon.Map {
+	transactionType := WebTransactionType.AsString()
+	if value, exists := attributes.Get("transactionType"); exists {
+		transactionType = value.AsString()
+	}
+	overflowTransactionName := fmt.Sprintf("%sTransaction/Other/%s", transactionType, overflowValue)
+	transactionName := ""
+	if value, exists := attributes.Get("transactionName"); exists {
+		transactionName = value.AsString()
+	}
+
+	overflow := pcommon.NewMap()
+	attributes.CopyTo(overflow)
+	for _, key := range highCardinalityAttributes {
+		value, exists := attributes.Get(key)
+		if !exists {
+			continue
+		}
+		switch {
+		case key == "transactionName" || key == "scope":
+			overflow.PutStr(key, overflowTransactionName)
+		case key == "metricTimesliceName" && value.AsString() == transactionName:
+			overflow.PutStr(key, overflowTransactionName)
+		default:
+			overflow.PutStr(key, overflowValue)
+		}
+	}
+	return overflow
+}
@@ -0,0 +1,161 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+func TestCardinalityLimits(t *testing.T) {
+	metrics := NewMetrics()
+	limits := NewCardinalityLimits(CardinalityLimitsConfig{MaxSeriesPerMetric: 2, Metrics: map[string]int{"unlimited": 0}})
+	rm := metrics.GetOrCreateLimitedResource(pcommon.NewMap(), limits)
+	for _, transactionName := range []string{"WebTransaction/Uri/a", "WebTransaction/Uri/b", "WebTransaction/Uri/c", "WebTransaction/Uri/a", "WebTransaction/Uri/d"} {
+		attributes := pcommon.NewMap()
+		attributes.PutStr("transactionType", "Web")
+		attributes.PutStr("transactionName", transactionName)
+		attributes.PutStr("metricTimesliceName", transactionName)
+		rm.AddHistogram("apm.service.transaction.duration", attributes, 0, 1, 1)
+		rm.IncrementMonotonicSum("unlimited", attributes, 0, 1)
+	}
+
+	otelMetrics := getAllMetrics(metrics.AppendOtelMetrics(pmetric.NewMetrics()))
+	durations := findMetric(t, "apm.service.transaction.duration", otelMetrics).ExponentialHistogram().DataPoints()
+	counts := make(map[string]uint64)
+	for i := 0; i < durations.Len(); i++ {
+		name, _ := durations.At(i).Attributes().Get("transactionName")
+		timesliceName, _ := durations.At(i).Attributes().Get("metricTimesliceName")
+		assert.Equal(t, name.Str(), timesliceName.Str())
+		counts[name.Str()] += durations.At(i).Count()
+	}
+	assert.Equal(t, map[string]uint64{"WebTransaction/Uri/a": 2, "WebTransaction/Uri/b": 1, "WebTransaction/Other/__overflow__": 2}, counts)
+
+	assert.Equal(t, 4, findMetric(t, "unlimited", otelMetrics).Sum().DataPoints().Len())
+
+	overflow := findMetric(t, "apm.service.cardinality.overflow.count", otelMetrics).Sum().DataPoints()
+	assert.Equal(t, 1, overflow.Len())
+	assert.Equal(t, int64(2), overflow.At(0).IntValue())
+	metricName, _ := overflow.At(0).Attributes().Get("metricName")
+	assert.Equal(t, "apm.service.transaction.duration", metricName.Str())
+}
+
+func TestGetOverflowAttributes(t *testing.T) {
+	attributes := pcommon.NewMap()
+	attributes.PutStr("transactionType", "Other")
+	attributes.PutStr("scope", "OtherTransaction/Consumer/kafka/orders/process")
+	attributes.PutStr("metricTimesliceName", "Datastore/statement/postgresql/orders_2023/SELECT")
+	attributes.PutStr("db.system", "postgresql")
+	attributes.PutStr("db.sql.table", "orders_2023")
+
+	assert.Equal(t, map[string]any{
+		"transactionType":     "Other",
+		"scope":               "OtherTransaction/Other/__overflow__",
+		"metricTimesliceName": "__overflow__",
+		"db.system":           "postgresql",
+		"db.sql.table":        "__overflow__",
+	}, getOverflowAttributes(attributes).AsRaw())
+}
+
+func TestConvertTracesWithCardinalityLimits(t *testing.T) {
+	traces := newTestTraces()
+	end := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+		setTestSpan(root, fmt.Sprintf("root %d", i), 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+		root.SetTraceID(pcommon.TraceID{byte(i + 1)})
+	}
+
+	config := &Config{ApdexT: 0.5, CardinalityLimits: CardinalityLimitsConfig{MaxSeriesPerMetric: 1}}
+	metrics := ConvertTraces(zap.NewNop(), config, traces)
+	sm := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0)
+
+	assert.Equal(t, 2, findMetric(t, "apm.service.transaction.sampled_duration", sm.Metrics()).ExponentialHistogram().DataPoints().Len())
+	overflow := findMetric(t, "apm.service.cardinality.overflow.count", sm.Metrics()).Sum().DataPoints()
+	overflowCounts := make(map[string]int64)
+	for i := 0; i < overflow.Len(); i++ {
+		metricName, _ := overflow.At(i).Attributes().Get("metricName")
+		overflowCounts[metricName.Str()] = overflow.At(i).IntValue()
+	}
+	assert.Equal(t, int64(2), overflowCounts["apm.service.transaction.sampled_duration"])
+}
+
+func TestCardinalityLimitsAcrossBatches(t *testing.T) {
+	end := time.Unix(1000, 0)
+	config := &Config{ApdexT: 0.5, CardinalityLimits: CardinalityLimitsConfig{MaxSeriesPerMetric: 1}}
+	state := newConnectorState(config)
+	var transactionNames []string
+	for i := 0; i < 3; i++ {
+		traces := newTestTraces()
+		setTestSpan(traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty(), fmt.Sprintf("root %d", i), 1, 0,
+			ptrace.SpanKindServer, end.Add(-time.Second), end)
+		metrics := convertTraces(zap.NewNop(), config, state, traces, end)
+		durations := findMetric(t, "apm.service.transaction.sampled_duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+		name, _ := durations.At(0).Attributes().Get("transactionName")
+		transactionNames = append(transactionNames, name.Str())
+	}
+	assert.Equal(t, []string{"WebTransaction/Other/root 0", "WebTransaction/Other/__overflow__", "WebTransaction/Other/__overflow__"}, transactionNames)
+}
+
+func TestCardinalityLimitsSeriesTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limits := NewCardinalityLimits(CardinalityLimitsConfig{MaxSeriesPerMetric: 1, SeriesTTL: time.Hour})
+	limits.now = func() time.Time { return now }
+
+	assert.True(t, limits.admit("resource", "apm.service.transaction.duration", "a"))
+	assert.False(t, limits.admit("resource", "apm.service.transaction.duration", "b"))
+	assert.True(t, limits.admit("other resource", "apm.service.transaction.duration", "b"))
+
+	now = now.Add(59 * time.Minute)
+	assert.True(t, limits.admit("resource", "apm.service.transaction.duration", "a"))
+	now = now.Add(59 * time.Minute)
+	assert.False(t, limits.admit("resource", "apm.service.transaction.duration", "b"))
+	// a was not seen for the TTL
+	now = now.Add(2 * time.Minute)
+	assert.True(t, limits.admit("resource", "apm.service.transaction.duration", "b"))
+}
+
+func TestConvertMetricsWithCardinalityLimits(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "shop")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("http.server.request.duration")
+	histogram.SetUnit("s")
+	dps := histogram.SetEmptyHistogram().DataPoints()
+	for _, route := range []string{"/cart", "/orders", "/users"} {
+		dp := dps.AppendEmpty()
+		dp.Attributes().PutStr("http.route", route)
+		dp.ExplicitBounds().FromRaw([]float64{0.5})
+		dp.BucketCounts().FromRaw([]uint64{1, 0})
+		dp.SetCount(1)
+	}
+
+	config := &Config{ApdexT: 0.5, CardinalityLimits: CardinalityLimitsConfig{Metrics: map[string]int{"apm.service.transaction.duration": 1}}}
+	converted := ConvertMetrics(zap.NewNop(), config, metrics)
+
+	durations := findMetric(t, "apm.service.transaction.duration", getAllMetrics(converted)).Histogram().DataPoints()
+	durationCounts := make(map[string]uint64)
+	for i := 0; i < durations.Len(); i++ {
+		name, _ := durations.At(i).Attributes().Get("transactionName")
+		durationCounts[name.Str()] += durations.At(i).Count()
+	}
+	assert.Equal(t, map[string]uint64{"WebTransaction/http.route/cart": 1, "WebTransaction/Other/__overflow__": 2}, durationCounts)
+
+	// the Apdex of the transactions has the same names
+	apdex := findMetric(t, "apm.service.transaction.apdex", getAllMetrics(converted)).Sum().DataPoints()
+	apdexCounts := make(map[string]int64)
+	for i := 0; i < apdex.Len(); i++ {
+		name, _ := apdex.At(i).Attributes().Get("transactionName")
+		apdexCounts[name.Str()] += apdex.At(i).IntValue()
+	}
+	assert.Equal(t, map[string]int64{"WebTransaction/http.route/cart": 1, "WebTransaction/Other/__overflow__": 2}, apdexCounts)
+}
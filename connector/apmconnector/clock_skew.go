@@ -0,0 +1,120 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"strconv"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	clockSkewMetricName        = "apm.service.clock_skew.count"
+	clockSkewMetricDescription = "Server spans that do not fit within their client parent span from another host. " +
+		"Only spans and parents of the same batch of traces are compared."
+)
+
+// resource attributes identifying the host whose clock timestamps the spans of a resource
+var clockDomainAttributes = []string{"host.id", "host.name", "k8s.node.name", "service.instance.id", "container.id", "k8s.pod.name"}
+
+// skewNode is a span of a batch, with its children.
+type skewNode struct {
+	span          ptrace.Span
+	resourceIndex int
+	clockDomain   string
+	children      []*skewNode
+}
+
+// AdjustClockSkew finds the server spans that do not fit within their client parent span when the two spans
+// were timestamped by different hosts, as in Jaeger. When correct is true, such spans are shifted into their
+// parent: centered in it, or starting with it when they are longer. The spans of the same host below a shifted
+// span are shifted as well. It returns the number of skewed spans of each resource of the batch.
+// Only spans of the batch are compared: a server span whose client parent came in another batch is neither
+// counted nor corrected, even when transactions are buffered across batches.
+func AdjustClockSkew(td ptrace.Traces, correct bool) []int {
+	skewedSpans := make([]int, td.ResourceSpans().Len())
+	nodes := make(map[string]*skewNode)
+	for i := 0; i < td.ResourceSpans().Len(); i++ {
+		rs := td.ResourceSpans().At(i)
+		clockDomain := strconv.Itoa(i)
+		if value, key := GetFirst(rs.Resource().Attributes(), clockDomainAttributes); key != "" {
+			clockDomain = key + "=" + value.AsString()
+		}
+		for j := 0; j < rs.ScopeSpans().Len(); j++ {
+			spans := rs.ScopeSpans().At(j).Spans()
+			for k := 0; k < spans.Len(); k++ {
+				span := spans.At(k)
+				nodes[getSpanKey(span.TraceID(), span.SpanID())] = &skewNode{span: span, resourceIndex: i, clockDomain: clockDomain}
+			}
+		}
+	}
+
+	var roots []*skewNode
+	for _, node := range nodes {
+		parent, exists := nodes[getSpanKey(node.span.TraceID(), node.span.ParentSpanID())]
+		if node.span.ParentSpanID().IsEmpty() || !exists || parent == node {
+			roots = append(roots, node)
+			continue
+		}
+		parent.children = append(parent.children, node)
+	}
+
+	type adjustedNode struct {
+		node            *skewNode
+		adjustmentNanos int64
+	}
+	// spans whose parents form a cycle have no root ancestor, they are never reached from the roots
+	stack := make([]adjustedNode, 0, len(roots))
+	for _, root := range roots {
+		stack = append(stack, adjustedNode{node: root})
+	}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		parent := current.node.span
+		for _, child := range current.node.children {
+			adjustmentNanos := int64(0)
+			if child.clockDomain == current.node.clockDomain {
+				adjustmentNanos = current.adjustmentNanos
+			} else if parent.Kind() == ptrace.SpanKindClient && child.span.Kind() == ptrace.SpanKindServer {
+				skewNanos := getClockSkew(int64(parent.StartTimestamp())+current.adjustmentNanos, int64(parent.EndTimestamp())+current.adjustmentNanos,
+					int64(child.span.StartTimestamp()), int64(child.span.EndTimestamp()))
+				if skewNanos != 0 {
+					skewedSpans[child.resourceIndex]++
+				}
+				if correct {
+					adjustmentNanos = skewNanos
+				}
+			}
+			if adjustmentNanos != 0 {
+				shiftSpan(child.span, adjustmentNanos)
+			}
+			stack = append(stack, adjustedNode{node: child, adjustmentNanos: adjustmentNanos})
+		}
+	}
+	return skewedSpans
+}
+
+// getClockSkew returns how much the child must be shifted to fit within its parent, 0 when it already does.
+func getClockSkew(parentStart int64, parentEnd int64, childStart int64, childEnd int64) int64 {
+	if childStart >= parentStart && childEnd <= parentEnd {
+		return 0
+	}
+	parentDuration, childDuration := parentEnd-parentStart, childEnd-childStart
+	if childDuration > parentDuration {
+		return parentStart - childStart
+	}
+	// the network latency is assumed to be the same both ways
+	return parentStart + (parentDuration-childDuration)/2 - childStart
+}
+
+func shiftSpan(span ptrace.Span, nanos int64) {
+	span.SetStartTimestamp(pcommon.Timestamp(int64(span.StartTimestamp()) + nanos))
+	span.SetEndTimestamp(pcommon.Timestamp(int64(span.EndTimestamp()) + nanos))
+	for i := 0; i < span.Events().Len(); i++ {
+		event := span.Events().At(i)
+		event.SetTimestamp(pcommon.Timestamp(int64(event.Timestamp()) + nanos))
+	}
+}
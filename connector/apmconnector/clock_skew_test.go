@@ -0,0 +1,76 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// newSkewedTestTraces returns a client span of host a calling a server span of host b, whose clock is
+// 1.5s late, and a child of the server span.
+func newSkewedTestTraces() ptrace.Traces {
+	start := time.Unix(1000, 0)
+	traces := newTestTraces()
+	traces.ResourceSpans().At(0).Resource().Attributes().PutStr("host.name", "a")
+	clientSpans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	setTestSpan(clientSpans.AppendEmpty(), "GET /", 1, 0, ptrace.SpanKindServer, start, start.Add(4*time.Second))
+	setTestSpan(clientSpans.AppendEmpty(), "GET /users", 2, 1, ptrace.SpanKindClient, start.Add(time.Second), start.Add(3*time.Second))
+
+	backend := traces.ResourceSpans().AppendEmpty()
+	backend.Resource().Attributes().PutStr("service.name", "users")
+	backend.Resource().Attributes().PutStr("instrumentation.provider", "newrelic-opentelemetry")
+	backend.Resource().Attributes().PutStr("host.name", "b")
+	serverSpans := backend.ScopeSpans().AppendEmpty().Spans()
+	setTestSpan(serverSpans.AppendEmpty(), "GET /users", 3, 2, ptrace.SpanKindServer, start.Add(-time.Second), start)
+	setTestSpan(serverSpans.AppendEmpty(), "SELECT users", 4, 3, ptrace.SpanKindClient, start.Add(-500*time.Millisecond), start)
+	return traces
+}
+
+func TestAdjustClockSkew(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	traces := newSkewedTestTraces()
+	assert.Equal(t, []int{0, 1}, AdjustClockSkew(traces, false))
+	server := traces.ResourceSpans().At(1).ScopeSpans().At(0).Spans().At(0)
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(-time.Second)), server.StartTimestamp())
+
+	assert.Equal(t, []int{0, 1}, AdjustClockSkew(traces, true))
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(1500*time.Millisecond)), server.StartTimestamp())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(2500*time.Millisecond)), server.EndTimestamp())
+	child := traces.ResourceSpans().At(1).ScopeSpans().At(0).Spans().At(1)
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(2*time.Second)), child.StartTimestamp())
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(2500*time.Millisecond)), child.EndTimestamp())
+
+	assert.Equal(t, []int{0, 0}, AdjustClockSkew(traces, true))
+}
+
+func TestAdjustClockSkewIgnoresSpansOfTheSameHost(t *testing.T) {
+	start := time.Unix(1000, 0)
+	traces := newTestTraces()
+	spans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	setTestSpan(spans.AppendEmpty(), "GET /", 1, 0, ptrace.SpanKindClient, start, start.Add(time.Second))
+	// async work, or a call to the same host
+	setTestSpan(spans.AppendEmpty(), "GET /", 2, 1, ptrace.SpanKindServer, start.Add(time.Second), start.Add(2*time.Second))
+
+	assert.Equal(t, []int{0}, AdjustClockSkew(traces, true))
+	assert.Equal(t, pcommon.NewTimestampFromTime(start.Add(time.Second)), spans.At(1).StartTimestamp())
+}
+
+func TestConvertTracesCountsClockSkew(t *testing.T) {
+	traces := newSkewedTestTraces()
+	original := ptrace.NewTraces()
+	traces.CopyTo(original)
+
+	metrics := ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5, ClockSkew: ClockSkewConfig{Correct: true}}, traces)
+
+	assert.Equal(t, original, traces)
+	checkSumMetric(t, clockSkewMetricName, 1, getAllMetrics(metrics))
+	assert.Equal(t, clockSkewMetricDescription, findMetric(t, clockSkewMetricName, getAllMetrics(metrics)).Description())
+}
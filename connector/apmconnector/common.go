@@ -19,33 +19,24 @@ func ShouldProcess(logger *zap.Logger, rs pcommon.Resource) bool {
 	return true
 }
 
-func ContainsErrorHTTPStatusCode(attributes pcommon.Map) bool {
-	statusCodeValue, statusCodeKey := GetFirst(attributes, []string{"http.response.status_code", "http.status_code"})
-	if statusCodeKey != "" && statusCodeValue.Type() == pcommon.ValueTypeInt {
-		return statusCodeValue.Int() >= 500
-	}
-	return false
-}
-
-func GetApdexFromExplicitHistogramBounds(bounds []float64, bucketCounts []uint64, unit string, apdex Apdex) (uint64, uint64, uint64) {
-	if unit != "s" && unit != "ms" {
+// GetApdexFromExplicitHistogramBounds returns the satisfying, tolerating and failing counts of a histogram.
+// By default, a bucket is attributed to a single zone based on its upper bound. When interpolate is true,
+// the count of a bucket containing a threshold is split linearly across the zones.
+func GetApdexFromExplicitHistogramBounds(bounds []float64, bucketCounts []uint64, unit string, apdex Apdex, interpolate bool) (uint64, uint64, uint64) {
+	satisfying, tolerating, supportedUnit := getApdexThresholds(unit, apdex)
+	if !supportedUnit {
 		return 0, 0, 0
 	}
 
-	satisfying := apdex.apdexSatisfying
-	tolerating := apdex.apdexTolerating
-	if unit == "ms" {
-		satisfying = satisfying * 1000
-		tolerating = tolerating * 1000
-	}
-
-	var s uint64
-	var t uint64
-	var f uint64
-
+	counter := apdexZoneCounter{satisfying: satisfying, tolerating: tolerating, interpolate: interpolate}
 	for i := 0; i < len(bucketCounts); i++ {
 		count := bucketCounts[i]
 
+		// durations are never negative
+		lower := 0.0
+		if i > 0 {
+			lower = bounds[i-1]
+		}
 		var upper float64
 		if i < len(bucketCounts)-1 {
 			upper = bounds[i]
@@ -53,14 +44,96 @@ func GetApdexFromExplicitHistogramBounds(bounds []float64, bucketCounts []uint64
 			upper = math.Inf(1)
 		}
 
-		if upper <= satisfying {
-			s += count
-		} else if upper <= tolerating {
-			t += count
+		counter.add(lower, upper, count)
+	}
+
+	return counter.counts()
+}
+
+// GetApdexFromExponentialHistogram is the exponential histogram counterpart of GetApdexFromExplicitHistogramBounds.
+// The positive bucket at index i covers (base^(offset+i), base^(offset+i+1)] where base is 2^(2^-scale).
+// The zero bucket and the negative buckets are satisfying.
+func GetApdexFromExponentialHistogram(scale int32, zeroCount uint64, positiveOffset int32, positiveBucketCounts []uint64,
+	negativeBucketCounts []uint64, unit string, apdex Apdex, interpolate bool) (uint64, uint64, uint64) {
+	satisfying, tolerating, supportedUnit := getApdexThresholds(unit, apdex)
+	if !supportedUnit {
+		return 0, 0, 0
+	}
+
+	counter := apdexZoneCounter{satisfying: satisfying, tolerating: tolerating, interpolate: interpolate}
+	counter.add(0, 0, zeroCount)
+	for _, count := range negativeBucketCounts {
+		counter.add(0, 0, count)
+	}
+
+	inverseFactor := math.Exp2(-float64(scale))
+	for i, count := range positiveBucketCounts {
+		lower := math.Exp2((float64(positiveOffset) + float64(i)) * inverseFactor)
+		upper := math.Exp2((float64(positiveOffset) + float64(i) + 1) * inverseFactor)
+		counter.add(lower, upper, count)
+	}
+
+	return counter.counts()
+}
+
+// apdexZoneCounter attributes the counts of histogram buckets to apdex zones.
+type apdexZoneCounter struct {
+	satisfying, tolerating float64
+	interpolate            bool
+	s, t, f                float64
+	total                  uint64
+}
+
+func (counter *apdexZoneCounter) add(lower float64, upper float64, count uint64) {
+	counter.total += count
+	if !counter.interpolate || math.IsInf(upper, 1) || upper <= lower {
+		if upper <= counter.satisfying {
+			counter.s += float64(count)
+		} else if upper <= counter.tolerating {
+			counter.t += float64(count)
 		} else {
-			f += count
+			counter.f += float64(count)
 		}
+		return
 	}
 
-	return s, t, f
+	// share of the bucket below each threshold, assuming the values are evenly distributed in the bucket
+	satisfyingShare := math.Min(math.Max((counter.satisfying-lower)/(upper-lower), 0), 1)
+	toleratingShare := math.Min(math.Max((counter.tolerating-lower)/(upper-lower), 0), 1)
+	counter.s += float64(count) * satisfyingShare
+	counter.t += float64(count) * (toleratingShare - satisfyingShare)
+	counter.f += float64(count) * (1 - toleratingShare)
+}
+
+// counts rounds the zone counts so that they still add up to the total count.
+func (counter *apdexZoneCounter) counts() (uint64, uint64, uint64) {
+	s := uint64(math.Round(counter.s))
+	t := uint64(math.Round(counter.s+counter.t)) - s
+	return s, t, counter.total - s - t
+}
+
+// getApdexThresholds returns the satisfying and tolerating thresholds converted to the unit of a histogram.
+func getApdexThresholds(unit string, apdex Apdex) (float64, float64, bool) {
+	switch unit {
+	case "ns":
+		return apdex.apdexSatisfying * 1e9, apdex.apdexTolerating * 1e9, true
+	case "us":
+		return apdex.apdexSatisfying * 1e6, apdex.apdexTolerating * 1e6, true
+	case "ms":
+		return apdex.apdexSatisfying * 1e3, apdex.apdexTolerating * 1e3, true
+	case "s":
+		return apdex.apdexSatisfying, apdex.apdexTolerating, true
+	case "min":
+		return apdex.apdexSatisfying / 60, apdex.apdexTolerating / 60, true
+	case "h":
+		return apdex.apdexSatisfying / 3600, apdex.apdexTolerating / 3600, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// IsDurationUnit returns true for the units apdex can be computed from.
+func IsDurationUnit(unit string) bool {
+	_, _, supportedUnit := getApdexThresholds(unit, Apdex{})
+	return supportedUnit
 }
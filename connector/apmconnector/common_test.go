@@ -43,10 +43,162 @@ func TestApdexFromExplicitHistogramBounds(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			satisfying, tolerating, failing := GetApdexFromExplicitHistogramBounds(tt.boundaries, tt.bucketCounts, tt.unit, tt.apdex)
+			satisfying, tolerating, failing := GetApdexFromExplicitHistogramBounds(tt.boundaries, tt.bucketCounts, tt.unit, tt.apdex, false)
 			assert.Equal(t, tt.s, satisfying)
 			assert.Equal(t, tt.t, tolerating)
 			assert.Equal(t, tt.f, failing)
 		})
 	}
 }
+
+func TestApdexFromExponentialHistogram(t *testing.T) {
+	var tests = []struct {
+		name                 string
+		scale                int32
+		zeroCount            uint64
+		positiveOffset       int32
+		positiveBucketCounts []uint64
+		negativeBucketCounts []uint64
+		unit                 string
+		apdex                Apdex
+		s                    uint64
+		t                    uint64
+		f                    uint64
+	}{
+		{
+			// buckets: (1/16, 1/8], (1/8, 1/4], (1/4, 1/2], (1/2, 1], (1, 2], (2, 4]
+			"Scale 0 seconds",
+			0,
+			2,
+			-4,
+			[]uint64{1, 1, 1, 1, 1, 1},
+			nil,
+			"s",
+			NewApdex(0.5),
+			5,
+			2,
+			1,
+		},
+		{
+			// buckets: (2^6, 2^6.5], (2^6.5, 2^7], ..., (2^11, 2^11.5]
+			"Scale 1 milliseconds",
+			1,
+			0,
+			12,
+			[]uint64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			nil,
+			"ms",
+			NewApdex(0.5),
+			5,
+			4,
+			2,
+		},
+		{
+			"Negative buckets",
+			0,
+			0,
+			0,
+			[]uint64{1},
+			[]uint64{3},
+			"s",
+			NewApdex(0.5),
+			3,
+			1,
+			0,
+		},
+		{
+			"Unsupported unit",
+			0,
+			1,
+			0,
+			[]uint64{1},
+			nil,
+			"By",
+			NewApdex(0.5),
+			0,
+			0,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			satisfying, tolerating, failing := GetApdexFromExponentialHistogram(tt.scale, tt.zeroCount, tt.positiveOffset,
+				tt.positiveBucketCounts, tt.negativeBucketCounts, tt.unit, tt.apdex, false)
+			assert.Equal(t, tt.s, satisfying)
+			assert.Equal(t, tt.t, tolerating)
+			assert.Equal(t, tt.f, failing)
+		})
+	}
+}
+
+func TestInterpolatedApdexFromExplicitHistogramBounds(t *testing.T) {
+	var tests = []struct {
+		name         string
+		boundaries   []float64
+		bucketCounts []uint64
+		unit         string
+		apdex        Apdex
+		s            uint64
+		t            uint64
+		f            uint64
+	}{
+		{
+			// 0.5 is halfway through (0, 1], 2 is in (1, 2.5]
+			"Thresholds inside buckets",
+			[]float64{1, 2.5, 5},
+			[]uint64{10, 30, 10, 10},
+			"s",
+			NewApdex(0.5),
+			5,
+			25,
+			30,
+		},
+		{
+			// 0.5 is a bucket boundary, 2 is in (1, 2.5]
+			"Default bounds seconds",
+			[]float64{0, .005, .01, .025, .05, .075, .1, .25, .5, .750, 1, 2.5, 5, 7.5, 10},
+			[]uint64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 3, 1, 1, 1, 1},
+			"s",
+			NewApdex(0.5),
+			9,
+			4,
+			5,
+		},
+		{
+			"Microseconds",
+			[]float64{250000, 750000, 2500000},
+			[]uint64{2, 4, 6, 8},
+			"us",
+			NewApdex(0.5),
+			4,
+			6,
+			10,
+		},
+		{
+			"Minutes",
+			[]float64{0.005, 0.025, 0.05},
+			[]uint64{4, 4, 4, 4},
+			"min",
+			NewApdex(0.6),
+			5,
+			5,
+			6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			satisfying, tolerating, failing := GetApdexFromExplicitHistogramBounds(tt.boundaries, tt.bucketCounts, tt.unit, tt.apdex, true)
+			assert.Equal(t, tt.s, satisfying)
+			assert.Equal(t, tt.t, tolerating)
+			assert.Equal(t, tt.f, failing)
+		})
+	}
+}
+
+func TestInterpolatedApdexFromExponentialHistogram(t *testing.T) {
+	// buckets: (1/4, 1/2], (1/2, 1], (1, 2], (2, 4]
+	satisfying, tolerating, failing := GetApdexFromExponentialHistogram(0, 1, -2, []uint64{4, 4, 4, 4}, nil, "s", NewApdex(0.75), true)
+	assert.Equal(t, uint64(7), satisfying)
+	assert.Equal(t, uint64(8), tolerating)
+	assert.Equal(t, uint64(2), failing)
+}
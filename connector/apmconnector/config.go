@@ -3,6 +3,337 @@
 
 package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
 
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+)
+
 type Config struct {
 	ApdexT float64 `mapstructure:"apdexT"`
+	// Apdex T used instead of ApdexT for specific services or transactions.
+	ApdexTOverrides []ApdexTOverride `mapstructure:"apdex_overrides"`
+	// When true, the Apdex computed from histograms splits the count of the buckets containing
+	// a threshold linearly across zones, instead of using the upper bound of the bucket.
+	ApdexInterpolation bool `mapstructure:"apdex_interpolation"`
+
+	// How long a transaction is kept after its root span has been seen, so that child spans arriving
+	// in later batches are still attributed to it. When zero, transactions are processed at the end
+	// of each batch.
+	TransactionGracePeriod time.Duration `mapstructure:"transaction_grace_period"`
+	// Maximum time a transaction is kept before being processed, whether or not its root span
+	// has been seen. Only used when TransactionGracePeriod is set.
+	TransactionMaxWait time.Duration `mapstructure:"transaction_max_wait"`
+	// Maximum number of transactions kept at once. Beyond it, the transactions buffered the longest are
+	// processed early, whether or not they are complete. Only used when TransactionGracePeriod is set.
+	MaxBufferedTransactions int `mapstructure:"max_buffered_transactions"`
+
+	// Interval over which metrics are aggregated before being sent. When zero, metrics are sent
+	// for every batch.
+	AggregationInterval time.Duration `mapstructure:"aggregation_interval"`
+	// Temporality of the aggregated metrics, either "delta" (the default) or "cumulative".
+	// Only used when AggregationInterval is set.
+	AggregationTemporality string `mapstructure:"aggregation_temporality"`
+
+	// Services for which transaction duration, error and apdex metrics are derived from spans.
+	SpanDerivedMetrics SpanDerivedMetricsConfig `mapstructure:"span_derived_metrics"`
+
+	// How URL paths are turned into transaction names when http.route is not known.
+	URLNormalization URLNormalizationConfig `mapstructure:"url_normalization"`
+
+	// Rules deciding which transactions are errors.
+	Errors ErrorsConfig `mapstructure:"errors"`
+
+	// Slowest transactions emitted as log records by the traces to logs connector.
+	SlowTransactions SlowTransactionsConfig `mapstructure:"slow_transactions"`
+
+	// Sample of the transactions emitted as log records by the traces to logs connector.
+	TransactionEvents TransactionEventsConfig `mapstructure:"transaction_events"`
+
+	// How traces whose root span is an internal span, such as scheduled jobs, are reported.
+	BackgroundTransactions BackgroundTransactionsConfig `mapstructure:"background_transactions"`
+
+	// How the spans of transactions whose root span was never seen are reported.
+	OrphanSpans OrphanSpansConfig `mapstructure:"orphan_spans"`
+
+	// How the clocks of the hosts sending the spans of a trace are reconciled.
+	ClockSkew ClockSkewConfig `mapstructure:"clock_skew"`
+
+	// How long an instance of a service is reported as live after it was last seen.
+	InstanceStaleness time.Duration `mapstructure:"instance_staleness"`
+
+	// Limits on the number of series of the APM metrics.
+	CardinalityLimits CardinalityLimitsConfig `mapstructure:"cardinality_limits"`
+
+	// Resource attributes kept on the APM metrics in addition to the default ones.
+	ResourceAttributes ResourceAttributesConfig `mapstructure:"resource_attributes"`
+}
+
+type ApdexTOverride struct {
+	// Pattern of the service.name the override applies to, all services when empty.
+	ServiceName string `mapstructure:"service_name"`
+	// Pattern of the transaction names the override applies to, for example
+	// `WebTransaction/http.route/api/search*`. All transactions when empty.
+	TransactionName string  `mapstructure:"transaction_name"`
+	ApdexT          float64 `mapstructure:"apdexT"`
+}
+
+type SpanDerivedMetricsConfig struct {
+	// Values of telemetry.sdk.language for which metrics are derived from spans, for example `ruby`.
+	Languages []string `mapstructure:"languages"`
+	// When true, metrics are also derived from spans for the languages whose SDKs are known
+	// not to emit duration metrics.
+	AutoDetect bool `mapstructure:"auto_detect"`
+}
+
+type URLNormalizationConfig struct {
+	// When true, numeric, UUID and hexadecimal path segments are kept instead of being replaced with `*`.
+	DisableDefaultRules bool `mapstructure:"disable_default_rules"`
+	// Regular expressions rewriting paths, applied in order before the default rules.
+	Rules []URLRewriteRule `mapstructure:"rules"`
+	// Allow-lists of path segments, applied after the other rules.
+	SegmentTerms []SegmentTermsRule `mapstructure:"segment_terms"`
+}
+
+type URLRewriteRule struct {
+	// Regular expression matching the parts of the path to rewrite, for example `^/static/.*`.
+	Match string `mapstructure:"match"`
+	// Replacement of the matches, which can refer to submatches such as `$1`.
+	Replacement string `mapstructure:"replacement"`
+}
+
+type SegmentTermsRule struct {
+	// Prefix of the paths the rule applies to, for example `/api`.
+	Prefix string `mapstructure:"prefix"`
+	// Segments kept after the prefix, other segments are replaced with `*`.
+	Terms []string `mapstructure:"terms"`
+}
+
+type ErrorsConfig struct {
+	// What makes a transaction an error. HTTP status codes default to `500-599`.
+	ErrorMatchConfig `mapstructure:",squash"`
+	// When true, the span status is not used to find errors.
+	IgnoreSpanStatus bool `mapstructure:"ignore_span_status"`
+	// Errors counted separately, which do not affect Apdex.
+	Expected ErrorMatchConfig `mapstructure:"expected"`
+	// Errors which are not counted at all.
+	Ignored ErrorMatchConfig `mapstructure:"ignored"`
+	// Exception a failed transaction is attributed to when counting errors by class, either
+	// "innermost" (the default) or "first".
+	ClassAttribution string `mapstructure:"class_attribution"`
+	// Maximum number of error classes per service, errors of additional classes are counted as `Other`.
+	// Defaults to 100.
+	MaxClasses int `mapstructure:"max_classes"`
+}
+
+type ErrorMatchConfig struct {
+	// HTTP status codes, such as `404`, or ranges of status codes, such as `500-599`.
+	HTTPStatusCodes []string `mapstructure:"http_status_codes"`
+	// Values of rpc.grpc.status_code.
+	GRPCStatusCodes []int64 `mapstructure:"grpc_status_codes"`
+	// Patterns of the exception.type of span exception events.
+	ExceptionTypes []string `mapstructure:"exception_types"`
+}
+
+type SlowTransactionsConfig struct {
+	// When true, the slowest transactions of each transaction name are emitted at the end of each interval.
+	Enabled bool `mapstructure:"enabled"`
+	// Number of transactions emitted per transaction name and interval. Defaults to 1.
+	MaxPerTransactionName int `mapstructure:"max_per_transaction_name"`
+	// Transactions faster than this are never emitted.
+	Threshold time.Duration `mapstructure:"threshold"`
+	// Interval over which the slowest transactions are selected. Defaults to 1m.
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// getInterval returns the interval over which the slowest transactions are selected.
+func (config SlowTransactionsConfig) getInterval() time.Duration {
+	if config.Interval == 0 {
+		return defaultSlowTransactionsInterval
+	}
+	return config.Interval
+}
+
+type TransactionEventsConfig struct {
+	// When true, a sample of the transactions is emitted at the end of each aggregation interval,
+	// or of each batch when not aggregating.
+	Enabled bool `mapstructure:"enabled"`
+	// Maximum number of transactions emitted per resource and interval. Defaults to 1000.
+	MaxSamples int `mapstructure:"max_samples"`
+}
+
+type BackgroundTransactionsConfig struct {
+	// Name of the transactions, in which `{scope}` and `{span}` are replaced with the instrumentation scope
+	// and the name of the root span. Defaults to `OtherTransaction/Custom/{scope}/{span}`.
+	Name string `mapstructure:"name"`
+}
+
+type OrphanSpansConfig struct {
+	// When true, the datastore, external and messaging metrics of orphan spans are recorded with
+	// TransactionName instead of being dropped.
+	Enabled bool `mapstructure:"enabled"`
+	// Transaction name of the metrics of orphan spans. Defaults to `WebTransaction/Other/Unknown`.
+	TransactionName string `mapstructure:"transaction_name"`
+}
+
+// getTransactionName returns the transaction name of the metrics of orphan spans, empty when they are dropped.
+func (config OrphanSpansConfig) getTransactionName() string {
+	if !config.Enabled {
+		return ""
+	}
+	if config.TransactionName == "" {
+		return defaultOrphanTransactionName
+	}
+	return config.TransactionName
+}
+
+type ClockSkewConfig struct {
+	// When true, server spans that do not fit within their client parent span from another host are
+	// shifted into it. Skewed spans are counted either way. Only spans of the same batch are compared,
+	// transaction buffering does not extend the detection to spans of other batches.
+	Correct bool `mapstructure:"correct"`
+}
+
+type CardinalityLimitsConfig struct {
+	// Maximum number of series of each metric per resource, no limit when zero.
+	MaxSeriesPerMetric int `mapstructure:"max_series_per_metric"`
+	// Maximum number of series per resource of specific metrics, by metric name.
+	Metrics map[string]int `mapstructure:"metrics"`
+	// How long a series counts towards the limit of its metric after it was last seen. Defaults to 1h.
+	SeriesTTL time.Duration `mapstructure:"series_ttl"`
+}
+
+func (config CardinalityLimitsConfig) getSeriesTTL() time.Duration {
+	if config.SeriesTTL == 0 {
+		return defaultSeriesTTL
+	}
+	return config.SeriesTTL
+}
+
+type ResourceAttributesConfig struct {
+	// Patterns of the resource attributes to keep, for example `k8s.*` or `cloud.region`.
+	Include []string `mapstructure:"include"`
+	// Patterns of the resource attributes to drop, including default ones.
+	Exclude []string `mapstructure:"exclude"`
+}
+
+var _ component.Config = (*Config)(nil)
+
+// Validate checks if the connector configuration is valid
+func (cfg *Config) Validate() error {
+	for _, override := range cfg.ApdexTOverrides {
+		if override.ServiceName == "" && override.TransactionName == "" {
+			return errors.New("apdex_overrides require a service_name or a transaction_name")
+		}
+		if override.ApdexT <= 0 {
+			return errors.New("apdex_overrides require a positive apdexT")
+		}
+	}
+	if cfg.TransactionGracePeriod < 0 {
+		return errors.New("transaction_grace_period must not be negative")
+	}
+	if cfg.TransactionGracePeriod > 0 && cfg.TransactionMaxWait < cfg.TransactionGracePeriod {
+		return errors.New("transaction_max_wait must be greater than or equal to transaction_grace_period")
+	}
+	if cfg.SlowTransactions.Interval < 0 {
+		return errors.New("slow_transactions interval must not be negative")
+	}
+	if cfg.MaxBufferedTransactions < 0 {
+		return errors.New("max_buffered_transactions must not be negative")
+	}
+	if cfg.AggregationInterval < 0 {
+		return errors.New("aggregation_interval must not be negative")
+	}
+	if cfg.AggregationTemporality != "" && cfg.AggregationTemporality != deltaTemporality &&
+		cfg.AggregationTemporality != cumulativeTemporality {
+		return fmt.Errorf("aggregation_temporality must be either %q or %q", deltaTemporality, cumulativeTemporality)
+	}
+	for _, errorMatch := range []ErrorMatchConfig{cfg.Errors.ErrorMatchConfig, cfg.Errors.Expected, cfg.Errors.Ignored} {
+		for _, statusCodes := range errorMatch.HTTPStatusCodes {
+			if _, err := parseStatusCodeRange(statusCodes); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rule := range cfg.URLNormalization.Rules {
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("invalid url_normalization rule %q: %w", rule.Match, err)
+		}
+	}
+	for _, rule := range cfg.URLNormalization.SegmentTerms {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			return fmt.Errorf("url_normalization segment_terms prefix %q must start with /", rule.Prefix)
+		}
+	}
+	if cfg.Errors.ClassAttribution != "" && cfg.Errors.ClassAttribution != firstExceptionAttribution &&
+		cfg.Errors.ClassAttribution != innermostExceptionAttribution {
+		return fmt.Errorf("errors class_attribution must be either %q or %q", firstExceptionAttribution, innermostExceptionAttribution)
+	}
+	if cfg.Errors.MaxClasses < 0 {
+		return errors.New("errors max_classes must not be negative")
+	}
+	if cfg.SlowTransactions.MaxPerTransactionName < 0 {
+		return errors.New("slow_transactions max_per_transaction_name must not be negative")
+	}
+	if cfg.SlowTransactions.Threshold < 0 {
+		return errors.New("slow_transactions threshold must not be negative")
+	}
+	if cfg.TransactionEvents.MaxSamples < 0 {
+		return errors.New("transaction_events max_samples must not be negative")
+	}
+	if cfg.InstanceStaleness < 0 {
+		return errors.New("instance_staleness must not be negative")
+	}
+	if name := cfg.OrphanSpans.TransactionName; name != "" && !strings.HasPrefix(name, "WebTransaction/") &&
+		!strings.HasPrefix(name, "OtherTransaction/") {
+		return errors.New("orphan_spans transaction_name must start with WebTransaction/ or OtherTransaction/")
+	}
+	if cfg.CardinalityLimits.MaxSeriesPerMetric < 0 {
+		return errors.New("cardinality_limits max_series_per_metric must not be negative")
+	}
+	if cfg.CardinalityLimits.SeriesTTL < 0 {
+		return errors.New("cardinality_limits series_ttl must not be negative")
+	}
+	for metricName, maxSeries := range cfg.CardinalityLimits.Metrics {
+		if maxSeries < 0 {
+			return fmt.Errorf("cardinality_limits of %q must not be negative", metricName)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) isTransactionBufferingEnabled() bool {
+	return cfg.TransactionGracePeriod > 0
+}
+
+// needsTracesCopy returns true when spans are modified or kept after the traces have been consumed.
+func (cfg *Config) needsTracesCopy() bool {
+	return cfg.isTransactionBufferingEnabled() || cfg.ClockSkew.Correct
+}
+
+// languages whose OpenTelemetry SDKs do not emit http or rpc server duration metrics
+var languagesWithoutDurationMetrics = []string{"ruby", "php"}
+
+func (cfg SpanDerivedMetricsConfig) isEnabledFor(sdkLanguage string) bool {
+	for _, language := range cfg.Languages {
+		if strings.EqualFold(language, sdkLanguage) {
+			return true
+		}
+	}
+	if cfg.AutoDetect {
+		for _, language := range languagesWithoutDurationMetrics {
+			if strings.EqualFold(language, sdkLanguage) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cfg *Config) isAggregationEnabled() bool {
+	return cfg.AggregationInterval > 0
 }
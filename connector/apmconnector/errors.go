@@ -0,0 +1,261 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	exceptionEventName            = "exception"
+	ExceptionTypeAttributeName    = "exception.type"
+	ExceptionMessageAttributeName = "exception.message"
+	ErrorClassAttributeName       = "error.class"
+)
+
+const (
+	// a failed transaction is attributed to the earliest exception
+	firstExceptionAttribution = "first"
+	// a failed transaction is attributed to the exception of the deepest span, the default
+	innermostExceptionAttribution = "innermost"
+
+	defaultMaxErrorClasses = 100
+	overflowErrorClass     = "Other"
+	unknownErrorClass      = "UnknownError"
+)
+
+// ExceptionEvent is an exception recorded on one of the spans of a transaction.
+type ExceptionEvent struct {
+	SpanID        string
+	Timestamp     pcommon.Timestamp
+	ExceptionType string
+	Message       string
+}
+
+// GetExceptionEvents returns the exception events of a span.
+func GetExceptionEvents(span ptrace.Span) []ExceptionEvent {
+	var exceptions []ExceptionEvent
+	for i := 0; i < span.Events().Len(); i++ {
+		event := span.Events().At(i)
+		if event.Name() != exceptionEventName {
+			continue
+		}
+		exception := ExceptionEvent{SpanID: span.SpanID().String(), Timestamp: event.Timestamp()}
+		if exceptionType, exists := event.Attributes().Get(ExceptionTypeAttributeName); exists {
+			exception.ExceptionType = exceptionType.AsString()
+		}
+		if message, exists := event.Attributes().Get(ExceptionMessageAttributeName); exists {
+			exception.Message = message.AsString()
+		}
+		exceptions = append(exceptions, exception)
+	}
+	return exceptions
+}
+
+type ErrorKind int
+
+const (
+	NotAnError ErrorKind = iota
+	// Error is counted as an error and is failing for Apdex
+	Error
+	// ExpectedError is counted separately from errors and does not affect Apdex
+	ExpectedError
+)
+
+var defaultErrorHTTPStatusCodes = []string{"500-599"}
+
+// ErrorClassifier decides whether spans and metric datapoints are errors, based on the configured rules.
+type ErrorClassifier struct {
+	errors, expected, ignored errorMatcher
+	ignoreSpanStatus          bool
+}
+
+type errorMatcher struct {
+	httpStatusCodes []statusCodeRange
+	grpcStatusCodes []int64
+	exceptionTypes  []string
+}
+
+type statusCodeRange struct {
+	from, to int64
+}
+
+// errorFacts are what errors are classified from
+type errorFacts struct {
+	httpStatusCode, grpcStatusCode       int64
+	hasHTTPStatusCode, hasGRPCStatusCode bool
+	spanStatusError                      bool
+	exceptionTypes                       []string
+}
+
+func NewErrorClassifier(config ErrorsConfig) *ErrorClassifier {
+	errors := config.ErrorMatchConfig
+	if errors.HTTPStatusCodes == nil {
+		errors.HTTPStatusCodes = defaultErrorHTTPStatusCodes
+	}
+	return &ErrorClassifier{
+		errors:           newErrorMatcher(errors),
+		expected:         newErrorMatcher(config.Expected),
+		ignored:          newErrorMatcher(config.Ignored),
+		ignoreSpanStatus: config.IgnoreSpanStatus,
+	}
+}
+
+func newErrorMatcher(config ErrorMatchConfig) errorMatcher {
+	matcher := errorMatcher{grpcStatusCodes: config.GRPCStatusCodes, exceptionTypes: config.ExceptionTypes}
+	for _, value := range config.HTTPStatusCodes {
+		// status codes are validated with the configuration
+		if statusCodes, err := parseStatusCodeRange(value); err == nil {
+			matcher.httpStatusCodes = append(matcher.httpStatusCodes, statusCodes)
+		}
+	}
+	return matcher
+}
+
+// parseStatusCodeRange parses a status code, such as `404`, or a range of status codes, such as `500-599`.
+func parseStatusCodeRange(value string) (statusCodeRange, error) {
+	fromValue, toValue, isRange := strings.Cut(strings.TrimSpace(value), "-")
+	from, err := strconv.ParseInt(strings.TrimSpace(fromValue), 10, 64)
+	if err != nil {
+		return statusCodeRange{}, fmt.Errorf("invalid status code %q", value)
+	}
+	if !isRange {
+		return statusCodeRange{from: from, to: from}, nil
+	}
+	to, err := strconv.ParseInt(strings.TrimSpace(toValue), 10, 64)
+	if err != nil || to < from {
+		return statusCodeRange{}, fmt.Errorf("invalid status code range %q", value)
+	}
+	return statusCodeRange{from: from, to: to}, nil
+}
+
+// ClassifySpan classifies a span from its status, its status code attributes and its exception events.
+func (classifier *ErrorClassifier) ClassifySpan(span ptrace.Span) ErrorKind {
+	facts := getErrorFacts(span.Attributes())
+	facts.spanStatusError = !classifier.ignoreSpanStatus && span.Status().Code() == ptrace.StatusCodeError
+	for _, exception := range GetExceptionEvents(span) {
+		if exception.ExceptionType != "" {
+			facts.exceptionTypes = append(facts.exceptionTypes, exception.ExceptionType)
+		}
+	}
+	return classifier.classify(facts)
+}
+
+// ClassifyAttributes classifies a metric datapoint from its status code attributes. Without status codes,
+// as for messaging metrics, datapoints of failed operations are recognized by their `error.type`.
+func (classifier *ErrorClassifier) ClassifyAttributes(attributes pcommon.Map) ErrorKind {
+	facts := getErrorFacts(attributes)
+	if !facts.hasHTTPStatusCode && !facts.hasGRPCStatusCode {
+		_, hasErrorType := attributes.Get("error.type")
+		facts.spanStatusError = !classifier.ignoreSpanStatus && hasErrorType
+	}
+	return classifier.classify(facts)
+}
+
+func (classifier *ErrorClassifier) classify(facts errorFacts) ErrorKind {
+	if !facts.spanStatusError && !classifier.errors.matches(facts) {
+		return NotAnError
+	}
+	if classifier.ignored.matches(facts) {
+		return NotAnError
+	}
+	if classifier.expected.matches(facts) {
+		return ExpectedError
+	}
+	return Error
+}
+
+func (matcher errorMatcher) matches(facts errorFacts) bool {
+	if facts.hasHTTPStatusCode {
+		for _, statusCodes := range matcher.httpStatusCodes {
+			if facts.httpStatusCode >= statusCodes.from && facts.httpStatusCode <= statusCodes.to {
+				return true
+			}
+		}
+	}
+	if facts.hasGRPCStatusCode {
+		for _, statusCode := range matcher.grpcStatusCodes {
+			if facts.grpcStatusCode == statusCode {
+				return true
+			}
+		}
+	}
+	for _, exceptionType := range facts.exceptionTypes {
+		for _, pattern := range matcher.exceptionTypes {
+			if MatchGlob(pattern, exceptionType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getErrorFacts(attributes pcommon.Map) errorFacts {
+	facts := errorFacts{}
+	facts.httpStatusCode, facts.hasHTTPStatusCode = getIntAttribute(attributes, "http.response.status_code", "http.status_code")
+	facts.grpcStatusCode, facts.hasGRPCStatusCode = getIntAttribute(attributes, "rpc.grpc.status_code")
+	return facts
+}
+
+func getIntAttribute(attributes pcommon.Map, keys ...string) (int64, bool) {
+	value, key := GetFirst(attributes, keys)
+	if key != "" && value.Type() == pcommon.ValueTypeInt {
+		return value.Int(), true
+	}
+	return 0, false
+}
+
+// GetErrorClass returns the class and the message of the error of a failed transaction. The error is taken
+// from the exceptions recorded on the spans of the transaction, picking the first or the innermost one
+// depending on the attribution. Without exceptions, the class is derived from the status code of the root span.
+func GetErrorClass(rootSpan ptrace.Span, exceptions []ExceptionEvent, spanParents map[string]string, attribution string) (string, string) {
+	var selected *ExceptionEvent
+	selectedDepth := -1
+	for i := range exceptions {
+		exception := &exceptions[i]
+		if exception.ExceptionType == "" {
+			continue
+		}
+		depth := 0
+		if attribution != firstExceptionAttribution {
+			depth = getSpanDepth(exception.SpanID, spanParents)
+		}
+		if selected == nil || depth > selectedDepth || (depth == selectedDepth && exception.Timestamp < selected.Timestamp) {
+			selected = exception
+			selectedDepth = depth
+		}
+	}
+	if selected != nil {
+		return selected.ExceptionType, selected.Message
+	}
+
+	facts := getErrorFacts(rootSpan.Attributes())
+	switch {
+	case facts.hasHTTPStatusCode:
+		return fmt.Sprintf("HTTP %d", facts.httpStatusCode), rootSpan.Status().Message()
+	case facts.hasGRPCStatusCode:
+		return fmt.Sprintf("gRPC %d", facts.grpcStatusCode), rootSpan.Status().Message()
+	default:
+		return unknownErrorClass, rootSpan.Status().Message()
+	}
+}
+
+// getSpanDepth returns the number of known ancestors of a span.
+func getSpanDepth(spanID string, spanParents map[string]string) int {
+	depth := 0
+	getParentID := func(spanID string) (string, bool) {
+		parentID, exists := spanParents[spanID]
+		return parentID, exists
+	}
+	forEachAncestor(spanID, getParentID, func(string) bool {
+		depth++
+		return true
+	})
+	return depth
+}
@@ -0,0 +1,134 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func TestClassifyAttributesDefault(t *testing.T) {
+	classifier := NewErrorClassifier(ErrorsConfig{})
+	assert.Equal(t, Error, classifier.ClassifyAttributes(newStatusCodeAttributes("http.response.status_code", 500)))
+	assert.Equal(t, Error, classifier.ClassifyAttributes(newStatusCodeAttributes("http.status_code", 503)))
+	assert.Equal(t, NotAnError, classifier.ClassifyAttributes(newStatusCodeAttributes("http.response.status_code", 404)))
+	assert.Equal(t, NotAnError, classifier.ClassifyAttributes(newStatusCodeAttributes("rpc.grpc.status_code", 13)))
+	assert.Equal(t, NotAnError, classifier.ClassifyAttributes(pcommon.NewMap()))
+}
+
+func TestClassifyAttributes(t *testing.T) {
+	classifier := NewErrorClassifier(ErrorsConfig{
+		ErrorMatchConfig: ErrorMatchConfig{HTTPStatusCodes: []string{"400-599"}, GRPCStatusCodes: []int64{2, 13, 14}},
+		Expected:         ErrorMatchConfig{HTTPStatusCodes: []string{"404", "409"}, GRPCStatusCodes: []int64{2}},
+		Ignored:          ErrorMatchConfig{HTTPStatusCodes: []string{"499"}},
+	})
+	assert.Equal(t, Error, classifier.ClassifyAttributes(newStatusCodeAttributes("http.response.status_code", 400)))
+	assert.Equal(t, ExpectedError, classifier.ClassifyAttributes(newStatusCodeAttributes("http.response.status_code", 404)))
+	assert.Equal(t, ExpectedError, classifier.ClassifyAttributes(newStatusCodeAttributes("http.response.status_code", 409)))
+	assert.Equal(t, NotAnError, classifier.ClassifyAttributes(newStatusCodeAttributes("http.response.status_code", 499)))
+	assert.Equal(t, NotAnError, classifier.ClassifyAttributes(newStatusCodeAttributes("http.response.status_code", 302)))
+	assert.Equal(t, Error, classifier.ClassifyAttributes(newStatusCodeAttributes("rpc.grpc.status_code", 14)))
+	assert.Equal(t, ExpectedError, classifier.ClassifyAttributes(newStatusCodeAttributes("rpc.grpc.status_code", 2)))
+	assert.Equal(t, NotAnError, classifier.ClassifyAttributes(newStatusCodeAttributes("rpc.grpc.status_code", 5)))
+}
+
+func TestClassifySpan(t *testing.T) {
+	classifier := NewErrorClassifier(ErrorsConfig{
+		ErrorMatchConfig: ErrorMatchConfig{ExceptionTypes: []string{"java.lang.*"}},
+		Expected:         ErrorMatchConfig{ExceptionTypes: []string{"com.example.NotFoundException"}},
+		Ignored:          ErrorMatchConfig{ExceptionTypes: []string{"java.lang.InterruptedException"}},
+	})
+
+	span := ptrace.NewSpan()
+	assert.Equal(t, NotAnError, classifier.ClassifySpan(span))
+
+	span.Status().SetCode(ptrace.StatusCodeError)
+	assert.Equal(t, Error, classifier.ClassifySpan(span))
+
+	addExceptionEvent(span, "com.example.NotFoundException")
+	assert.Equal(t, ExpectedError, classifier.ClassifySpan(span))
+
+	span = ptrace.NewSpan()
+	addExceptionEvent(span, "java.lang.IllegalStateException")
+	assert.Equal(t, Error, classifier.ClassifySpan(span))
+
+	span = ptrace.NewSpan()
+	span.Status().SetCode(ptrace.StatusCodeError)
+	addExceptionEvent(span, "java.lang.InterruptedException")
+	assert.Equal(t, NotAnError, classifier.ClassifySpan(span))
+}
+
+func TestClassifySpanIgnoreSpanStatus(t *testing.T) {
+	classifier := NewErrorClassifier(ErrorsConfig{IgnoreSpanStatus: true})
+
+	span := ptrace.NewSpan()
+	span.Status().SetCode(ptrace.StatusCodeError)
+	assert.Equal(t, NotAnError, classifier.ClassifySpan(span))
+
+	span.Attributes().PutInt("http.response.status_code", 502)
+	assert.Equal(t, Error, classifier.ClassifySpan(span))
+}
+
+func TestParseStatusCodeRange(t *testing.T) {
+	statusCodes, err := parseStatusCodeRange("404")
+	assert.NoError(t, err)
+	assert.Equal(t, statusCodeRange{from: 404, to: 404}, statusCodes)
+
+	statusCodes, err = parseStatusCodeRange("500 - 599")
+	assert.NoError(t, err)
+	assert.Equal(t, statusCodeRange{from: 500, to: 599}, statusCodes)
+
+	_, err = parseStatusCodeRange("5xx")
+	assert.Error(t, err)
+	_, err = parseStatusCodeRange("599-500")
+	assert.Error(t, err)
+}
+
+func newStatusCodeAttributes(key string, statusCode int64) pcommon.Map {
+	attributes := pcommon.NewMap()
+	attributes.PutInt(key, statusCode)
+	return attributes
+}
+
+func addExceptionEvent(span ptrace.Span, exceptionType string) {
+	event := span.Events().AppendEmpty()
+	event.SetName("exception")
+	event.Attributes().PutStr("exception.type", exceptionType)
+}
+
+func TestGetErrorClass(t *testing.T) {
+	root := ptrace.NewSpan()
+	root.SetSpanID(pcommon.SpanID{1})
+	root.Attributes().PutInt("http.response.status_code", 500)
+	root.Status().SetMessage("Internal Server Error")
+
+	// the root span has a child, which has a child
+	spanParents := map[string]string{
+		pcommon.SpanID{2}.String(): pcommon.SpanID{1}.String(),
+		pcommon.SpanID{3}.String(): pcommon.SpanID{2}.String(),
+	}
+	exceptions := []ExceptionEvent{
+		{SpanID: pcommon.SpanID{1}.String(), Timestamp: 30, ExceptionType: "RuntimeError", Message: "request failed"},
+		{SpanID: pcommon.SpanID{3}.String(), Timestamp: 20, ExceptionType: "TimeoutError", Message: "query timed out"},
+		{SpanID: pcommon.SpanID{2}.String(), Timestamp: 10, ExceptionType: "ConnectionError", Message: "connection reset"},
+	}
+
+	errorClass, message := GetErrorClass(root, exceptions, spanParents, "")
+	assert.Equal(t, "TimeoutError", errorClass)
+	assert.Equal(t, "query timed out", message)
+
+	errorClass, message = GetErrorClass(root, exceptions, spanParents, firstExceptionAttribution)
+	assert.Equal(t, "ConnectionError", errorClass)
+	assert.Equal(t, "connection reset", message)
+
+	errorClass, message = GetErrorClass(root, nil, spanParents, innermostExceptionAttribution)
+	assert.Equal(t, "HTTP 500", errorClass)
+	assert.Equal(t, "Internal Server Error", message)
+
+	errorClass, _ = GetErrorClass(ptrace.NewSpan(), nil, nil, innermostExceptionAttribution)
+	assert.Equal(t, "UnknownError", errorClass)
+}
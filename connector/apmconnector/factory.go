@@ -7,6 +7,7 @@ package apmconnector // import "github.com/newrelic/opentelemetry-collector-comp
 
 import (
 	"context"
+	"time"
 
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/connector"
@@ -17,6 +18,7 @@ import (
 const (
 	Type                      = "newrelicapm"
 	TracesToMetricsStability  = component.StabilityLevelDevelopment
+	TracesToLogsStability     = component.StabilityLevelDevelopment
 	MetricsToMetricsStability = component.StabilityLevelDevelopment
 )
 
@@ -26,13 +28,16 @@ func NewFactory() connector.Factory {
 		Type,
 		createDefaultConfig,
 		connector.WithTracesToMetrics(createTracesToMetrics, TracesToMetricsStability),
+		connector.WithTracesToLogs(createTracesToLogs, TracesToLogsStability),
 		connector.WithMetricsToMetrics(createMetricsToMetrics, MetricsToMetricsStability),
 	)
 }
 
+const defaultTransactionMaxWait = 30 * time.Second
+
 // createDefaultConfig creates the default configuration.
 func createDefaultConfig() component.Config {
-	return &Config{}
+	return &Config{TransactionMaxWait: defaultTransactionMaxWait, AggregationTemporality: deltaTemporality}
 }
 
 // createTracesToMetrics creates a traces to metrics connector based on provided config.
@@ -44,11 +49,19 @@ func createTracesToMetrics(
 ) (connector.Traces, error) {
 	c := cfg.(*Config)
 
-	return &ApmMetricConnector{
-		config:          c,
-		metricsConsumer: nextConsumer,
-		logger:          set.Logger,
-	}, nil
+	return newApmMetricConnector(c, set.Logger, nextConsumer), nil
+}
+
+// createTracesToLogs creates a traces to logs connector based on provided config.
+func createTracesToLogs(
+	_ context.Context,
+	set connector.CreateSettings,
+	cfg component.Config,
+	nextConsumer consumer.Logs,
+) (connector.Traces, error) {
+	c := cfg.(*Config)
+
+	return newApmLogConnector(c, set.Logger, nextConsumer), nil
 }
 
 // createMetricsToMetrics creates a metrics to metrics connector based on provided config.
@@ -64,5 +77,7 @@ func createMetricsToMetrics(
 		config:          c,
 		metricsConsumer: nextConsumer,
 		logger:          set.Logger,
+		state:           newConnectorState(c),
+		done:            make(chan struct{}),
 	}, nil
 }
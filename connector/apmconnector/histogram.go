@@ -4,7 +4,11 @@
 package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
 
 import (
+	"math"
+	"sort"
+
 	"github.com/lightstep/go-expohisto/structure"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 )
 
@@ -54,3 +58,160 @@ func (h *Histogram) AddDatapointToHistogram(dp pmetric.ExponentialHistogramDataP
 		}
 	}
 }
+
+// mergeDataPoints merges the datapoints of a histogram, or exponential histogram, metric that have the same
+// attributes, such as the datapoints of a source metric that only differed by attributes that were dropped.
+func mergeDataPoints(metric pmetric.Metric) {
+	switch metric.Type() {
+	case pmetric.MetricTypeHistogram:
+		dps := metric.Histogram().DataPoints()
+		seriesIndexes := make(map[string]int, dps.Len())
+		merged := make(map[int]bool)
+		for i := 0; i < dps.Len(); i++ {
+			key := getKeyFromMap(dps.At(i).Attributes())
+			index, exists := seriesIndexes[key]
+			switch {
+			case !exists:
+				seriesIndexes[key] = i
+			case !hasValidBuckets(dps.At(index)):
+				// the malformed datapoint is skipped rather than merged into
+				merged[index] = true
+				seriesIndexes[key] = i
+			case !hasValidBuckets(dps.At(i)):
+				merged[i] = true
+			default:
+				mergeHistogramDataPoints(dps.At(index), dps.At(i))
+				merged[i] = true
+			}
+		}
+		i := 0
+		dps.RemoveIf(func(pmetric.HistogramDataPoint) bool {
+			i++
+			return merged[i-1]
+		})
+	case pmetric.MetricTypeExponentialHistogram:
+		dps := metric.ExponentialHistogram().DataPoints()
+		seriesIndexes := make(map[string]int, dps.Len())
+		merged := make(map[int]bool)
+		for i := 0; i < dps.Len(); i++ {
+			key := getKeyFromMap(dps.At(i).Attributes())
+			if index, exists := seriesIndexes[key]; exists {
+				mergeExponentialHistogramDataPoints(dps.At(index), dps.At(i))
+				merged[i] = true
+			} else {
+				seriesIndexes[key] = i
+			}
+		}
+		i := 0
+		dps.RemoveIf(func(pmetric.ExponentialHistogramDataPoint) bool {
+			i++
+			return merged[i-1]
+		})
+	}
+}
+
+// hasValidBuckets returns true when the datapoint has no buckets, or one bucket more than explicit bounds.
+func hasValidBuckets(dp pmetric.HistogramDataPoint) bool {
+	return dp.BucketCounts().Len() == 0 || dp.BucketCounts().Len() == dp.ExplicitBounds().Len()+1
+}
+
+// mergeHistogramDataPoints adds the counts of src to dst. When their bounds differ, each bucket of src is
+// added to the first bucket of dst whose upper bound is greater than or equal to its own. Both datapoints must
+// have valid buckets.
+func mergeHistogramDataPoints(dst pmetric.HistogramDataPoint, src pmetric.HistogramDataPoint) {
+	dstBounds := dst.ExplicitBounds().AsRaw()
+	if dst.BucketCounts().Len() == 0 && src.BucketCounts().Len() > 0 {
+		dst.BucketCounts().FromRaw(make([]uint64, len(dstBounds)+1))
+	}
+	for i := 0; i < src.BucketCounts().Len(); i++ {
+		upperBound := math.Inf(1)
+		if i < src.ExplicitBounds().Len() {
+			upperBound = src.ExplicitBounds().At(i)
+		}
+		j := sort.SearchFloat64s(dstBounds, upperBound)
+		dst.BucketCounts().SetAt(j, dst.BucketCounts().At(j)+src.BucketCounts().At(i))
+	}
+
+	if src.HasMin() && (!dst.HasMin() || src.Min() < dst.Min()) {
+		dst.SetMin(src.Min())
+	}
+	if src.HasMax() && (!dst.HasMax() || src.Max() > dst.Max()) {
+		dst.SetMax(src.Max())
+	}
+	dst.SetCount(dst.Count() + src.Count())
+	dst.SetSum(dst.Sum() + src.Sum())
+	dst.SetStartTimestamp(minTimestamp(dst.StartTimestamp(), src.StartTimestamp()))
+	dst.SetTimestamp(maxTimestamp(dst.Timestamp(), src.Timestamp()))
+}
+
+// mergeExponentialHistogramDataPoints adds the counts of src to dst, at the lowest scale of the two.
+func mergeExponentialHistogramDataPoints(dst pmetric.ExponentialHistogramDataPoint, src pmetric.ExponentialHistogramDataPoint) {
+	scale := dst.Scale()
+	if src.Scale() < scale {
+		scale = src.Scale()
+	}
+	mergeExponentialBuckets(dst.Positive(), dst.Scale(), src.Positive(), src.Scale(), scale)
+	mergeExponentialBuckets(dst.Negative(), dst.Scale(), src.Negative(), src.Scale(), scale)
+	dst.SetScale(scale)
+
+	if src.HasMin() && (!dst.HasMin() || src.Min() < dst.Min()) {
+		dst.SetMin(src.Min())
+	}
+	if src.HasMax() && (!dst.HasMax() || src.Max() > dst.Max()) {
+		dst.SetMax(src.Max())
+	}
+	dst.SetZeroCount(dst.ZeroCount() + src.ZeroCount())
+	dst.SetCount(dst.Count() + src.Count())
+	dst.SetSum(dst.Sum() + src.Sum())
+	dst.SetStartTimestamp(minTimestamp(dst.StartTimestamp(), src.StartTimestamp()))
+	dst.SetTimestamp(maxTimestamp(dst.Timestamp(), src.Timestamp()))
+}
+
+// mergeExponentialBuckets sets dst to the sum of the buckets of dst and src, downscaled to scale.
+func mergeExponentialBuckets(dst pmetric.ExponentialHistogramDataPointBuckets, dstScale int32,
+	src pmetric.ExponentialHistogramDataPointBuckets, srcScale int32, scale int32) {
+	counts := make(map[int32]uint64)
+	for _, buckets := range []struct {
+		buckets pmetric.ExponentialHistogramDataPointBuckets
+		scale   int32
+	}{{dst, dstScale}, {src, srcScale}} {
+		for i := 0; i < buckets.buckets.BucketCounts().Len(); i++ {
+			// a bucket of a lower scale covers 2^n buckets of the higher scale
+			index := (buckets.buckets.Offset() + int32(i)) >> (buckets.scale - scale)
+			counts[index] += buckets.buckets.BucketCounts().At(i)
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+
+	minIndex, maxIndex := int32(math.MaxInt32), int32(math.MinInt32)
+	for index := range counts {
+		if index < minIndex {
+			minIndex = index
+		}
+		if index > maxIndex {
+			maxIndex = index
+		}
+	}
+	bucketCounts := make([]uint64, maxIndex-minIndex+1)
+	for index, count := range counts {
+		bucketCounts[index-minIndex] = count
+	}
+	dst.SetOffset(minIndex)
+	dst.BucketCounts().FromRaw(bucketCounts)
+}
+
+func minTimestamp(a pcommon.Timestamp, b pcommon.Timestamp) pcommon.Timestamp {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+func maxTimestamp(a pcommon.Timestamp, b pcommon.Timestamp) pcommon.Timestamp {
+	if b > a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,95 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+)
+
+const (
+	instanceMetricName = "apm.service.instance.count"
+
+	defaultInstanceStaleness = 5 * time.Minute
+	// how often stale instances are reported when metrics are not aggregated, as a service whose instances
+	// all stopped sends no batch to report them on
+	instanceRecordInterval = 10 * time.Second
+)
+
+// resource attributes identifying an instance, from the most to the least specific
+var instanceIDAttributes = []string{"service.instance.id", "container.id", "k8s.pod.name", "host.name"}
+
+// InstanceInventory keeps track of the instances of each service. Instances seen since the last report are
+// reported as live with a gauge of value 1. Instances not seen for the staleness period are reported
+// one last time, with a datapoint flagged as having no recorded value, and forgotten.
+type InstanceInventory struct {
+	staleness time.Duration
+	// resource attributes excluded from the APM metrics are not used to name instances
+	attributeFilter *AttributeFilter
+	lock            sync.Mutex
+	instances       map[string]*instance
+}
+
+type instance struct {
+	resourceAttributes pcommon.Map
+	attributes         pcommon.Map
+	lastSeen           time.Time
+	reported           bool
+}
+
+func NewInstanceInventory(config *Config) *InstanceInventory {
+	staleness := config.InstanceStaleness
+	if staleness == 0 {
+		staleness = defaultInstanceStaleness
+	}
+	return &InstanceInventory{staleness: staleness, attributeFilter: NewAttributeFilter(nil, config.ResourceAttributes.Exclude),
+		instances: make(map[string]*instance)}
+}
+
+// Observe records that the instance described by the resource attributes is live. The instance is reported
+// with the filtered attributes of the resource, it is ignored when it can not be identified by an attribute
+// that is not excluded.
+func (inventory *InstanceInventory) Observe(resourceAttributes pcommon.Map, filteredResourceAttributes pcommon.Map, now time.Time) {
+	instanceID := pcommon.NewValueEmpty()
+	for _, key := range instanceIDAttributes {
+		if value, exists := resourceAttributes.Get(key); exists && !inventory.attributeFilter.isExcluded(key) {
+			instanceID = value
+			break
+		}
+	}
+	if instanceID.Type() == pcommon.ValueTypeEmpty {
+		return
+	}
+	attributes := pcommon.NewMap()
+	attributes.PutStr("instanceName", instanceID.AsString())
+	displayName := instanceID.AsString()
+	if hostName, exists := resourceAttributes.Get("host.name"); exists && !inventory.attributeFilter.isExcluded("host.name") {
+		displayName = hostName.AsString()
+	}
+	attributes.PutStr("host.displayName", displayName)
+
+	inventory.lock.Lock()
+	defer inventory.lock.Unlock()
+	key := getKeyFromMap(filteredResourceAttributes) + instanceID.AsString()
+	inventory.instances[key] = &instance{resourceAttributes: filteredResourceAttributes, attributes: attributes, lastSeen: now}
+}
+
+// Record reports the instances seen since the last report, and the instances that became stale.
+func (inventory *InstanceInventory) Record(metrics Metrics, now time.Time) {
+	timestamp := pcommon.NewTimestampFromTime(now)
+
+	inventory.lock.Lock()
+	defer inventory.lock.Unlock()
+	for key, instance := range inventory.instances {
+		if now.Sub(instance.lastSeen) >= inventory.staleness {
+			metrics.GetOrCreateResource(instance.resourceAttributes).SetStaleGauge(instanceMetricName, instance.attributes, timestamp)
+			delete(inventory.instances, key)
+		} else if !instance.reported {
+			metrics.GetOrCreateResource(instance.resourceAttributes).SetGauge(instanceMetricName, instance.attributes, timestamp, 1)
+			instance.reported = true
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+func TestConvertTracesReportsInstances(t *testing.T) {
+	end := time.Unix(1000, 0)
+	traces := newTestTraces()
+	traces.ResourceSpans().At(0).Resource().Attributes().PutStr("container.id", "4a1ee3c2")
+	spans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	setTestSpan(spans.AppendEmpty(), "GET /", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	// instances are reported once per resource
+	traces.ResourceSpans().At(0).ScopeSpans().AppendEmpty().Spans().AppendEmpty().SetSpanID(pcommon.SpanID{2})
+
+	metrics := ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5}, traces)
+
+	instances := findMetric(t, instanceMetricName, getAllMetrics(metrics)).Gauge().DataPoints()
+	assert.Equal(t, 1, instances.Len())
+	assert.Equal(t, int64(1), instances.At(0).IntValue())
+	assert.Equal(t, map[string]any{"instanceName": "4a1ee3c2", "host.displayName": "4a1ee3c2"}, instances.At(0).Attributes().AsRaw())
+}
+
+func TestConvertMetricsReportsInstances(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "cart")
+	rm.Resource().Attributes().PutStr("service.instance.id", "cart-1")
+	rm.Resource().Attributes().PutStr("host.name", "node-7")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("http.server.request.duration")
+	histogram.SetUnit("s")
+	dp := histogram.SetEmptyHistogram().DataPoints().AppendEmpty()
+	dp.Attributes().PutStr("http.route", "/api/cart")
+	dp.SetCount(1)
+
+	converted := ConvertMetrics(zap.NewNop(), &Config{ApdexT: 0.5}, metrics)
+
+	instances := findMetric(t, instanceMetricName, getAllMetrics(converted)).Gauge().DataPoints()
+	assert.Equal(t, 1, instances.Len())
+	assert.Equal(t, map[string]any{"instanceName": "cart-1", "host.displayName": "node-7"}, instances.At(0).Attributes().AsRaw())
+}
+
+func TestInstanceInventoryHonoursExcludedAttributes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	inventory := NewInstanceInventory(&Config{ResourceAttributes: ResourceAttributesConfig{Exclude: []string{"service.instance.id", "host.*"}}})
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("service.name", "cart")
+	resourceAttributes.PutStr("service.instance.id", "cart-1")
+	resourceAttributes.PutStr("container.id", "4a1ee3c2")
+	resourceAttributes.PutStr("host.name", "node-7")
+	inventory.Observe(resourceAttributes, pcommon.NewMap(), now)
+
+	metrics := NewMetrics()
+	inventory.Record(metrics, now)
+	instances := getInstanceDatapoints(t, metrics)
+	assert.Equal(t, map[string]any{"instanceName": "4a1ee3c2", "host.displayName": "4a1ee3c2"}, instances.At(0).Attributes().AsRaw())
+}
+
+func TestInstanceInventoryStaleness(t *testing.T) {
+	now := time.Unix(1000, 0)
+	inventory := NewInstanceInventory(&Config{InstanceStaleness: time.Minute})
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("service.name", "cart")
+	resourceAttributes.PutStr("k8s.pod.name", "cart-5d8f")
+	inventory.Observe(resourceAttributes, resourceAttributes, now)
+	// instances that can not be identified are ignored
+	inventory.Observe(pcommon.NewMap(), pcommon.NewMap(), now)
+
+	metrics := NewMetrics()
+	inventory.Record(metrics, now)
+	instances := getInstanceDatapoints(t, metrics)
+	assert.Equal(t, 1, instances.Len())
+	assert.Equal(t, int64(1), instances.At(0).IntValue())
+
+	// already reported, and not stale yet
+	metrics = NewMetrics()
+	inventory.Record(metrics, now.Add(30*time.Second))
+	assert.Empty(t, metrics)
+
+	metrics = NewMetrics()
+	inventory.Record(metrics, now.Add(time.Minute))
+	instances = getInstanceDatapoints(t, metrics)
+	assert.Equal(t, 1, instances.Len())
+	assert.True(t, instances.At(0).Flags().NoRecordedValue())
+	assert.Empty(t, inventory.instances)
+}
+
+func TestStaleInstancesAreReportedWithoutBatches(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sink := new(consumertest.MetricsSink)
+	config := &Config{ApdexT: 0.5, InstanceStaleness: time.Minute}
+	connector := &OpenTelemetryMetricToApmMetricConnector{config: config, logger: zap.NewNop(), metricsConsumer: sink,
+		state: newConnectorState(config), done: make(chan struct{})}
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("service.name", "cart")
+	resourceAttributes.PutStr("service.instance.id", "cart-1")
+	connector.state.instances.Observe(resourceAttributes, resourceAttributes, now)
+
+	assert.NoError(t, connector.recordInstances(context.Background(), now))
+	assert.NoError(t, connector.recordInstances(context.Background(), now.Add(30*time.Second)))
+	assert.Equal(t, 1, len(sink.AllMetrics()))
+	assert.NoError(t, connector.recordInstances(context.Background(), now.Add(time.Minute)))
+	assert.Equal(t, 2, len(sink.AllMetrics()))
+	instances := findMetric(t, instanceMetricName, getAllMetrics(sink.AllMetrics()[1])).Gauge().DataPoints()
+	assert.True(t, instances.At(0).Flags().NoRecordedValue())
+}
+
+func TestCumulativeAggregationDoesNotRepeatGauges(t *testing.T) {
+	start := time.Unix(1000, 0)
+	aggregator := NewMetricsAggregator(cumulativeTemporality, defaultSeriesTTL, start)
+	metrics := aggregator.Metrics()
+	resourceMetrics := metrics.GetOrCreateResource(pcommon.NewMap())
+	resourceMetrics.SetGauge(instanceMetricName, pcommon.NewMap(), pcommon.NewTimestampFromTime(start), 1)
+
+	assert.Equal(t, 1, aggregator.Flush(start.Add(time.Minute)).MetricCount())
+	assert.Equal(t, 0, aggregator.Flush(start.Add(2*time.Minute)).MetricCount())
+}
+
+func getInstanceDatapoints(t *testing.T, metrics Metrics) pmetric.NumberDataPointSlice {
+	t.Helper()
+	return findMetric(t, instanceMetricName, getAllMetrics(metrics.AppendOtelMetrics(pmetric.NewMetrics()))).Gauge().DataPoints()
+}
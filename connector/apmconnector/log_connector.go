@@ -0,0 +1,126 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// ApmLogConnector converts transactions to log records: one record per error occurrence, the traces
+// of the slowest transactions and a sample of all transactions.
+type ApmLogConnector struct {
+	tracesConnector
+
+	logsConsumer consumer.Logs
+
+	// state kept across batches, only used when slow transactions or transaction events are enabled
+	slowTransactions  *SlowTransactionTraces
+	transactionEvents *TransactionEvents
+}
+
+func newApmLogConnector(config *Config, logger *zap.Logger, nextConsumer consumer.Logs) *ApmLogConnector {
+	return &ApmLogConnector{
+		tracesConnector: newTracesConnector(config, logger, func() *TransactionsMap { return NewTransactionsMap(config) }),
+		logsConsumer:    nextConsumer,
+	}
+}
+
+func (c *ApmLogConnector) Capabilities() consumer.Capabilities {
+	return consumer.Capabilities{MutatesData: false}
+}
+
+func (c *ApmLogConnector) ConsumeTraces(ctx context.Context, td ptrace.Traces) error {
+	c.lock.Lock()
+	logs := c.newLogs()
+	// only log records are sent by this connector, no metrics are recorded
+	c.addTraces(td, nil, logs, time.Now())
+	if !c.config.isAggregationEnabled() {
+		c.flushTransactionEvents(logs)
+	}
+	c.lock.Unlock()
+
+	return c.consumeLogs(ctx, logs)
+}
+
+func (c *ApmLogConnector) Start(_ context.Context, _ component.Host) error {
+	c.logger.Info("Starting the APM Log Connector")
+	if c.config.SlowTransactions.Enabled {
+		c.slowTransactions = NewSlowTransactionTraces(c.config.SlowTransactions)
+	}
+	if c.config.TransactionEvents.Enabled {
+		c.transactionEvents = NewTransactionEvents(c.config.TransactionEvents)
+	}
+	c.start(func(ctx context.Context) error {
+		return c.flush(ctx, false, false, false)
+	})
+	if c.slowTransactions != nil {
+		c.flushEvery(c.config.SlowTransactions.getInterval(), func(ctx context.Context) error {
+			return c.flush(ctx, false, true, false)
+		})
+	}
+	if c.isAggregating() {
+		c.flushEvery(c.config.AggregationInterval, func(ctx context.Context) error {
+			return c.flush(ctx, false, false, true)
+		})
+	}
+	return nil
+}
+
+func (c *ApmLogConnector) Shutdown(ctx context.Context) error {
+	c.logger.Info("Stopping the APM Log Connector")
+	c.stop()
+
+	return c.flush(ctx, true, true, true)
+}
+
+// flush processes the buffered transactions that are complete, or all of them when forced,
+// and sends the resulting log records. Slow transactions are only sent at the end of their
+// interval, and transaction events at the end of the aggregation interval when aggregating.
+func (c *ApmLogConnector) flush(ctx context.Context, force bool, endOfSlowTransactionsInterval bool, endOfAggregationInterval bool) error {
+	c.lock.Lock()
+	logs := c.newLogs()
+	c.processCompletedTransactions(nil, logs, time.Now(), force)
+	if endOfSlowTransactionsInterval && c.slowTransactions != nil {
+		c.slowTransactions.Flush(logs)
+	}
+	if endOfAggregationInterval || !c.config.isAggregationEnabled() {
+		c.flushTransactionEvents(logs)
+	}
+	c.lock.Unlock()
+
+	return c.consumeLogs(ctx, logs)
+}
+
+// newLogs returns where the log records of processed transactions are recorded.
+func (c *ApmLogConnector) newLogs() *Logs {
+	logs := NewLogs()
+	logs.slowTransactions = c.slowTransactions
+	logs.transactionEvents = c.transactionEvents
+	return logs
+}
+
+// isAggregating returns true when transaction events are kept until the end of the aggregation interval.
+func (c *ApmLogConnector) isAggregating() bool {
+	return c.config.isAggregationEnabled() && c.transactionEvents != nil
+}
+
+// flushTransactionEvents adds the transaction events of the interval to the logs.
+func (c *ApmLogConnector) flushTransactionEvents(logs *Logs) {
+	if c.transactionEvents != nil {
+		c.transactionEvents.Flush(logs)
+	}
+}
+
+func (c *ApmLogConnector) consumeLogs(ctx context.Context, logs *Logs) error {
+	if logs.LogRecordCount() == 0 {
+		return nil
+	}
+	return c.logsConsumer.ConsumeLogs(ctx, logs.OtelLogs())
+}
@@ -0,0 +1,153 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/component/componenttest"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+func TestLogConnectorEmitsTransactionErrors(t *testing.T) {
+	sink := new(consumertest.LogsSink)
+	connector := newApmLogConnector(&Config{}, zap.NewNop(), sink)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+
+	end := time.Unix(1000, 0)
+	traces := newTestTraces()
+	traces.ResourceSpans().At(0).Resource().Attributes().PutStr("process.pid", "1234")
+	spans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	root := spans.AppendEmpty()
+	setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	root.Attributes().PutStr("http.route", "/users")
+	root.Attributes().PutStr("http.method", "GET")
+	root.Status().SetCode(ptrace.StatusCodeError)
+	child := spans.AppendEmpty()
+	setTestSpan(child, "child", 2, 1, ptrace.SpanKindClient, end.Add(-time.Second), end)
+	event := child.Events().AppendEmpty()
+	event.SetName("exception")
+	event.Attributes().PutStr("exception.type", "TimeoutError")
+	event.Attributes().PutStr("exception.message", "query timed out")
+
+	successful := spans.AppendEmpty()
+	setTestSpan(successful, "successful", 3, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	successful.SetTraceID(pcommon.TraceID{0x02})
+
+	assert.NoError(t, connector.ConsumeTraces(context.Background(), traces))
+	assert.NoError(t, connector.Shutdown(context.Background()))
+
+	assert.Len(t, sink.AllLogs(), 1)
+	logs := sink.AllLogs()[0]
+	assert.Equal(t, 1, logs.LogRecordCount())
+
+	resourceLogs := logs.ResourceLogs().At(0)
+	serviceName, _ := resourceLogs.Resource().Attributes().Get("service.name")
+	assert.Equal(t, "service", serviceName.Str())
+	_, exists := resourceLogs.Resource().Attributes().Get("process.pid")
+	assert.False(t, exists)
+
+	record := resourceLogs.ScopeLogs().At(0).LogRecords().At(0)
+	assert.Equal(t, root.TraceID(), record.TraceID())
+	assert.Equal(t, root.SpanID(), record.SpanID())
+	assert.Equal(t, plog.SeverityNumberError, record.SeverityNumber())
+	assert.Equal(t, "query timed out", record.Body().Str())
+	assert.Equal(t, map[string]any{
+		"event.name":      "apm.transaction.error",
+		"transactionName": "WebTransaction/http.route/users (GET)",
+		"transactionType": "Web",
+		"error.class":     "TimeoutError",
+		"error.message":   "query timed out",
+		"trace.id":        root.TraceID().String(),
+	}, record.Attributes().AsRaw())
+}
+
+func TestLogConnectorFlushesBufferedTransactionsOnShutdown(t *testing.T) {
+	sink := new(consumertest.LogsSink)
+	config := &Config{TransactionGracePeriod: time.Hour, TransactionMaxWait: time.Hour}
+	connector := newApmLogConnector(config, zap.NewNop(), sink)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+
+	end := time.Unix(1000, 0)
+	traces := newTestTraces()
+	root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+	setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	root.Attributes().PutInt("http.response.status_code", 503)
+
+	assert.NoError(t, connector.ConsumeTraces(context.Background(), traces))
+	assert.Empty(t, sink.AllLogs())
+
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	assert.Len(t, sink.AllLogs(), 1)
+	record := sink.AllLogs()[0].ResourceLogs().At(0).ScopeLogs().At(0).LogRecords().At(0)
+	errorClass, _ := record.Attributes().Get("error.class")
+	assert.Equal(t, "HTTP 503", errorClass.Str())
+}
+
+func TestLogConnectorEmitsSlowTransactionsAtTheEndOfTheInterval(t *testing.T) {
+	sink := new(consumertest.LogsSink)
+	// without aggregation, slow transactions are still only emitted at the end of their own interval
+	config := &Config{SlowTransactions: SlowTransactionsConfig{Enabled: true, Interval: time.Hour}}
+	connector := newApmLogConnector(config, zap.NewNop(), sink)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+
+	end := time.Unix(1000, 0)
+	for i, duration := range []time.Duration{time.Second, 3 * time.Second, 2 * time.Second} {
+		traces := newTestTraces()
+		spans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+		root := spans.AppendEmpty()
+		setTestSpan(root, "GET /users", 1, 0, ptrace.SpanKindServer, end.Add(-duration), end)
+		root.SetTraceID(pcommon.TraceID{byte(i + 1)})
+		child := spans.AppendEmpty()
+		setTestSpan(child, "load", 2, 1, ptrace.SpanKindInternal, end.Add(-duration), end.Add(-duration/2))
+		child.SetTraceID(pcommon.TraceID{byte(i + 1)})
+		assert.NoError(t, connector.ConsumeTraces(context.Background(), traces))
+	}
+	assert.Empty(t, sink.AllLogs())
+
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	assert.Len(t, sink.AllLogs(), 1)
+	assert.Equal(t, 1, sink.AllLogs()[0].LogRecordCount())
+	record := sink.AllLogs()[0].ResourceLogs().At(0).ScopeLogs().At(0).LogRecords().At(0)
+	assert.Equal(t, pcommon.TraceID{2}, record.TraceID())
+	eventName, _ := record.Attributes().Get("event.name")
+	assert.Equal(t, "apm.transaction.trace", eventName.Str())
+	assert.Equal(t, map[string]any{
+		"name":                "GET /users",
+		"spanId":              pcommon.SpanID{1}.String(),
+		"metricTimesliceName": "WebTransaction/Other/GET /users",
+		"startOffset":         0.0,
+		"duration":            3.0,
+		"exclusiveDuration":   1.5,
+		"children": []any{map[string]any{
+			"name":                "load",
+			"spanId":              pcommon.SpanID{2}.String(),
+			"metricTimesliceName": "Custom/load",
+			"startOffset":         0.0,
+			"duration":            1.5,
+			"exclusiveDuration":   1.5,
+		}},
+	}, record.Body().Map().AsRaw())
+}
+
+func TestNilMetricsRecordNothing(t *testing.T) {
+	var metrics Metrics
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("service.name", "service")
+	resourceMetrics := metrics.GetOrCreateLimitedResource(resourceAttributes, NewCardinalityLimits(CardinalityLimitsConfig{MaxSeriesPerMetric: 1}))
+	timestamp := pcommon.NewTimestampFromTime(time.Unix(1000, 0))
+	resourceMetrics.AddHistogram("apm.service.transaction.sampled_duration", pcommon.NewMap(), timestamp, timestamp, int64(time.Second))
+	resourceMetrics.IncrementMonotonicSum("apm.service.error.count", pcommon.NewMap(), timestamp, timestamp)
+	resourceMetrics.SetGauge(instanceMetricName, pcommon.NewMap(), timestamp, 1)
+
+	assert.Nil(t, metrics)
+	assert.Equal(t, "service", resourceMetrics.attributes.AsRaw()["service.name"])
+}
@@ -0,0 +1,83 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	// EventNameAttributeName tells apart the kinds of log records emitted by the connector
+	EventNameAttributeName = "event.name"
+	transactionErrorEvent  = "apm.transaction.error"
+)
+
+// Logs collects the log records produced while processing transactions, grouped by resource.
+type Logs struct {
+	logs      plog.Logs
+	resources map[string]plog.ScopeLogs
+	// slow transactions and transaction events of the current interval, they are only added to
+	// the logs when flushed
+	slowTransactions  *SlowTransactionTraces
+	transactionEvents *TransactionEvents
+}
+
+func NewLogs() *Logs {
+	return &Logs{logs: plog.NewLogs(), resources: make(map[string]plog.ScopeLogs)}
+}
+
+// AppendLogRecord adds an empty log record to the resource with the given attributes.
+func (logs *Logs) AppendLogRecord(resourceAttributes pcommon.Map) plog.LogRecord {
+	key := getKeyFromMap(resourceAttributes)
+	scopeLogs, exists := logs.resources[key]
+	if !exists {
+		resourceLogs := logs.logs.ResourceLogs().AppendEmpty()
+		resourceAttributes.CopyTo(resourceLogs.Resource().Attributes())
+		scopeLogs = resourceLogs.ScopeLogs().AppendEmpty()
+		logs.resources[key] = scopeLogs
+	}
+	return scopeLogs.LogRecords().AppendEmpty()
+}
+
+func (logs *Logs) LogRecordCount() int {
+	return logs.logs.LogRecordCount()
+}
+
+// OtelLogs returns the collected log records.
+func (logs *Logs) OtelLogs() plog.Logs {
+	return logs.logs
+}
+
+// AddTransaction records what is emitted for every processed transaction.
+func (logs *Logs) AddTransaction(transaction *Transaction, transactionName string, transactionType TransactionType, isError bool) {
+	if logs.slowTransactions != nil {
+		logs.slowTransactions.Offer(transaction, transactionName, transactionType)
+	}
+	if logs.transactionEvents != nil {
+		logs.transactionEvents.Offer(transaction, transactionName, transactionType, isError)
+	}
+}
+
+// AddTransactionError records an occurrence of an error, linked to the root span of the failed transaction.
+func (logs *Logs) AddTransactionError(resourceAttributes pcommon.Map, span ptrace.Span, transactionName string, transactionType TransactionType,
+	errorClass string, errorMessage string) {
+	record := logs.AppendLogRecord(resourceAttributes)
+	record.SetTimestamp(span.EndTimestamp())
+	record.SetObservedTimestamp(span.EndTimestamp())
+	record.SetSeverityNumber(plog.SeverityNumberError)
+	record.SetSeverityText("ERROR")
+	record.SetTraceID(span.TraceID())
+	record.SetSpanID(span.SpanID())
+	record.Body().SetStr(errorMessage)
+
+	attributes := record.Attributes()
+	attributes.PutStr(EventNameAttributeName, transactionErrorEvent)
+	attributes.PutStr("transactionName", transactionName)
+	attributes.PutStr("transactionType", transactionType.AsString())
+	attributes.PutStr(ErrorClassAttributeName, errorClass)
+	attributes.PutStr("error.message", errorMessage)
+	attributes.PutStr("trace.id", span.TraceID().String())
+}
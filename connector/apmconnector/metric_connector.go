@@ -5,9 +5,11 @@ package apmconnector // import "github.com/newrelic/opentelemetry-collector-comp
 
 import (
 	"context"
+	"time"
 
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.uber.org/zap"
@@ -16,10 +18,22 @@ import (
 const defaultApdexT = 0.5
 
 type ApmMetricConnector struct {
-	config *Config
-	logger *zap.Logger
+	tracesConnector
 
 	metricsConsumer consumer.Metrics
+	state           *connectorState
+
+	// state kept across batches, only used when aggregation is enabled
+	aggregator *MetricsAggregator
+}
+
+func newApmMetricConnector(config *Config, logger *zap.Logger, nextConsumer consumer.Metrics) *ApmMetricConnector {
+	state := newConnectorState(config)
+	return &ApmMetricConnector{
+		tracesConnector: newTracesConnector(config, logger, func() *TransactionsMap { return state.newTransactionsMap(config) }),
+		metricsConsumer: nextConsumer,
+		state:           state,
+	}
 }
 
 func (c *ApmMetricConnector) Capabilities() consumer.Capabilities {
@@ -27,28 +41,128 @@ func (c *ApmMetricConnector) Capabilities() consumer.Capabilities {
 }
 
 func (c *ApmMetricConnector) ConsumeTraces(ctx context.Context, td ptrace.Traces) error {
-	metrics := ConvertTraces(c.logger, c.config, td)
-	return c.metricsConsumer.ConsumeMetrics(ctx, metrics)
+	if !c.config.isTransactionBufferingEnabled() && !c.config.isAggregationEnabled() {
+		metrics := convertTraces(c.logger, c.config, c.state, td, time.Now())
+		return c.metricsConsumer.ConsumeMetrics(ctx, metrics)
+	}
+
+	c.lock.Lock()
+	metricMap := c.getMetrics()
+	now := time.Now()
+	c.addTraces(td, metricMap, nil, now)
+	c.state.recordServiceMapEdges(metricMap, now, false)
+	if !c.config.isAggregationEnabled() {
+		c.state.instances.Record(metricMap, now)
+	}
+	c.lock.Unlock()
+
+	if c.config.isAggregationEnabled() {
+		// metrics are sent at the end of the aggregation interval
+		return nil
+	}
+	return c.consumeMetrics(ctx, metricMap.AppendOtelMetrics(pmetric.NewMetrics()))
 }
 
 func (c *ApmMetricConnector) Start(_ context.Context, _ component.Host) error {
 	c.logger.Info("Starting the APM Metric Connector")
-	if c.config.ApdexT == 0 {
-		c.config.ApdexT = defaultApdexT
+	if c.config.isAggregationEnabled() {
+		c.aggregator = NewMetricsAggregator(c.config.AggregationTemporality, c.config.CardinalityLimits.getSeriesTTL(), time.Now())
+	}
+	c.start(func(ctx context.Context) error {
+		return c.flush(ctx, false, false)
+	})
+	if c.aggregator != nil {
+		c.flushEvery(c.config.AggregationInterval, func(ctx context.Context) error {
+			return c.flush(ctx, false, true)
+		})
+	} else {
+		// stale instances are reported even when no batch is received
+		c.flushEvery(instanceRecordInterval, func(ctx context.Context) error {
+			return c.flush(ctx, false, false)
+		})
 	}
 	return nil
 }
 
-func (c *ApmMetricConnector) Shutdown(context.Context) error {
+func (c *ApmMetricConnector) Shutdown(ctx context.Context) error {
 	c.logger.Info("Stopping the APM Metric Connector")
-	return nil
+	c.stop()
+
+	return c.flush(ctx, true, c.aggregator != nil)
+}
+
+// flush processes the buffered transactions that are complete, or all of them when forced,
+// and sends the resulting metrics. When aggregating, metrics are only sent at the end of the
+// interval. Stale instances are reported with the metrics that are sent.
+func (c *ApmMetricConnector) flush(ctx context.Context, force bool, endOfInterval bool) error {
+	c.lock.Lock()
+	now := time.Now()
+	metricMap := c.getMetrics()
+	c.processCompletedTransactions(metricMap, nil, now, force)
+	c.state.recordServiceMapEdges(metricMap, now, force)
+
+	var metrics pmetric.Metrics
+	if c.aggregator == nil {
+		c.state.instances.Record(metricMap, now)
+		metrics = metricMap.AppendOtelMetrics(pmetric.NewMetrics())
+	} else if endOfInterval {
+		c.state.instances.Record(c.aggregator.Metrics(), now)
+		metrics = c.aggregator.Flush(now)
+	}
+	c.lock.Unlock()
+
+	if metrics == (pmetric.Metrics{}) {
+		return nil
+	}
+	return c.consumeMetrics(ctx, metrics)
+}
+
+// getMetrics returns where metrics are recorded: the metrics of the current aggregation
+// interval, or new metrics when not aggregating.
+func (c *ApmMetricConnector) getMetrics() Metrics {
+	if c.aggregator != nil {
+		return c.aggregator.Metrics()
+	}
+	return NewMetrics()
+}
+
+func (c *ApmMetricConnector) consumeMetrics(ctx context.Context, metrics pmetric.Metrics) error {
+	if metrics.MetricCount() == 0 {
+		return nil
+	}
+	return c.metricsConsumer.ConsumeMetrics(ctx, metrics)
 }
 
 func ConvertTraces(logger *zap.Logger, config *Config, td ptrace.Traces) pmetric.Metrics {
-	attributesFilter := NewAttributeFilter()
-	transactions := NewTransactionsMap(config.ApdexT)
+	state := newConnectorState(config)
+	// no other batch follows, calls are recorded without waiting for their callee
+	state.serviceMapGracePeriod = 0
+	return convertTraces(logger, config, state, td, time.Now())
+}
+
+func convertTraces(logger *zap.Logger, config *Config, state *connectorState, td ptrace.Traces, now time.Time) pmetric.Metrics {
+	if config.ClockSkew.Correct {
+		// spans are shifted, we can't change data we don't own
+		traces := ptrace.NewTraces()
+		td.CopyTo(traces)
+		td = traces
+	}
+	transactions := state.newTransactionsMap(config)
 	metricMap := NewMetrics()
 
+	attributeFilter := NewAttributeFilter(config.ResourceAttributes.Include, config.ResourceAttributes.Exclude)
+	transactions.AddTraces(logger, attributeFilter, metricMap, td, now)
+	transactions.ProcessTransactions()
+	state.recordServiceMapEdges(metricMap, now, false)
+	state.instances.Record(metricMap, now)
+
+	return metricMap.AppendOtelMetrics(pmetric.NewMetrics())
+}
+
+// AddTraces adds the spans to the transactions they belong to. Metrics that do not depend on
+// transactions being complete are recorded right away in the given Metrics.
+func (transactions *TransactionsMap) AddTraces(logger *zap.Logger, attributesFilter *AttributeFilter, metricMap Metrics, td ptrace.Traces, now time.Time) {
+	skewedSpans := AdjustClockSkew(td, transactions.correctClockSkew)
 	for i := 0; i < td.ResourceSpans().Len(); i++ {
 		rs := td.ResourceSpans().At(i)
 		if !ShouldProcess(logger, rs.Resource()) {
@@ -59,27 +173,38 @@ func ConvertTraces(logger *zap.Logger, config *Config, td ptrace.Traces) pmetric
 		if err != nil {
 			logger.Error("Could not filter resource attributes", zap.String("error", err.Error()))
 		}
-		resourceMetrics := metricMap.GetOrCreateResource(resourceAttributes)
+		resourceMetrics := metricMap.GetOrCreateLimitedResource(resourceAttributes, transactions.cardinalityLimits)
+		if transactions.instances != nil {
+			transactions.instances.Observe(rs.Resource().Attributes(), resourceAttributes, now)
+		}
+		if skewedSpans[i] > 0 {
+			timestamp := pcommon.NewTimestampFromTime(now)
+			resourceMetrics.GetSum(clockSkewMetricName, pcommon.NewMap(), true, timestamp, timestamp).Add(int64(skewedSpans[i]), timestamp, timestamp)
+			resourceMetrics.SetDescription(clockSkewMetricName, clockSkewMetricDescription)
+		}
 
 		sdkLanguage := GetSdkLanguage(rs.Resource().Attributes())
+		serviceName := GetServiceName(rs.Resource().Attributes())
 		for j := 0; j < rs.ScopeSpans().Len(); j++ {
 			scopeSpan := rs.ScopeSpans().At(j)
 			for k := 0; k < scopeSpan.Spans().Len(); k++ {
 				span := scopeSpan.Spans().At(k)
-				if k == 0 {
-					if hostName, exists := resourceAttributes.Get("host.name"); exists {
-						GenerateInstanceMetric(resourceMetrics, hostName.AsString(), span.StartTimestamp(), span.EndTimestamp())
-					}
+				transaction, _ := transactions.GetOrCreateTransaction(sdkLanguage, span, resourceMetrics, rs.Resource().Attributes())
+				if transaction.createdAt.IsZero() {
+					transaction.createdAt = now
 				}
 
-				transaction, _ := transactions.GetOrCreateTransaction(sdkLanguage, span, resourceMetrics, rs.Resource().Attributes())
+				if transactions.serviceMap != nil {
+					transactions.serviceMap.AddSpan(span, serviceName, resourceAttributes, now)
+				}
 
+				rootSpan := transaction.RootSpan
 				transaction.AddSpan(span)
+				if transaction.RootSpan != rootSpan {
+					transaction.rootSetAt = now
+					transaction.rootScopeName = scopeSpan.Scope().Name()
+				}
 			}
 		}
 	}
-
-	transactions.ProcessTransactions()
-
-	return metricMap.AppendOtelMetrics(pmetric.NewMetrics())
 }
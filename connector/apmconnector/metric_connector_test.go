@@ -4,11 +4,14 @@
 package apmconnector
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/component/componenttest"
+	"go.opentelemetry.io/collector/consumer/consumertest"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/ptrace"
@@ -38,13 +41,95 @@ func TestConvertOneSpanToMetrics(t *testing.T) {
 	assert.Equal(t, "service", serviceName.AsString())
 	sm := rm.ScopeMetrics().At(0)
 
-	// TODO: The commented out metrics will be generated when we generate them from spans for languages like Ruby
-	// checkSumMetric(t, "apm.service.transaction.apdex", 1, sm.Metrics())
-	// checkSumMetric(t, "apm.service.apdex", 1, sm.Metrics())
 	checkHistogramMetric(t, "apm.service.overview.web", 1, sm.Metrics())
-	// checkHistogramMetric(t, "apm.service.transaction.duration", 1, sm.Metrics())
 	checkHistogramMetric(t, "apm.service.transaction.sampled_duration", 1, sm.Metrics())
 	checkHistogramMetric(t, "apm.service.transaction.overview", 1, sm.Metrics())
+	// the SDK generates duration metrics, apdex and errors are derived from them
+	checkNoMetric(t, "apm.service.transaction.duration", sm.Metrics())
+	checkNoMetric(t, "apm.service.apdex", sm.Metrics())
+}
+
+func TestConvertSpansToMetricsForSdkWithoutMetrics(t *testing.T) {
+	var tests = []struct {
+		name     string
+		language string
+		config   SpanDerivedMetricsConfig
+		enabled  bool
+	}{
+		{"Configured language", "ruby", SpanDerivedMetricsConfig{Languages: []string{"Ruby"}}, true},
+		{"Auto detected language", "php", SpanDerivedMetricsConfig{AutoDetect: true}, true},
+		{"Language emitting metrics", "java", SpanDerivedMetricsConfig{Languages: []string{"ruby"}, AutoDetect: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traces := newTestTraces()
+			traces.ResourceSpans().At(0).Resource().Attributes().PutStr("telemetry.sdk.language", tt.language)
+			end := time.Unix(1000, 0)
+			root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+			setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+			root.Status().SetCode(ptrace.StatusCodeError)
+
+			config := Config{ApdexT: 0.5, SpanDerivedMetrics: tt.config}
+			metrics := ConvertTraces(zap.NewNop(), &config, traces)
+			sm := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0)
+
+			if tt.enabled {
+				checkHistogramMetric(t, "apm.service.transaction.duration", 1, sm.Metrics())
+				checkSumMetric(t, "apm.service.error.count", 1, sm.Metrics())
+				checkSumMetric(t, "apm.service.transaction.error.count", 1, sm.Metrics())
+				checkSumMetric(t, "apm.service.apdex", 1, sm.Metrics())
+				checkSumMetric(t, "apm.service.transaction.apdex", 1, sm.Metrics())
+				zone, _ := findMetric(t, "apm.service.apdex", sm.Metrics()).Sum().DataPoints().At(0).Attributes().Get("apdex.zone")
+				assert.Equal(t, "F", zone.Str())
+			} else {
+				checkNoMetric(t, "apm.service.transaction.duration", sm.Metrics())
+				checkNoMetric(t, "apm.service.error.count", sm.Metrics())
+				checkNoMetric(t, "apm.service.apdex", sm.Metrics())
+			}
+		})
+	}
+}
+
+func TestConvertSpansToErrorClassMetrics(t *testing.T) {
+	end := time.Unix(1000, 0)
+	config := Config{ApdexT: 0.5, Errors: ErrorsConfig{MaxClasses: 1}}
+	state := newConnectorState(&config)
+	counts := make(map[string]int64)
+	// one transaction per batch, the error classes of the service are known across batches
+	for _, exceptionType := range []string{"TimeoutError", "ConnectionError", "TimeoutError"} {
+		traces := newTestTraces()
+		root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+		setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+		root.Status().SetCode(ptrace.StatusCodeError)
+		addExceptionEvent(root, "RuntimeError")
+
+		child := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+		setTestSpan(child, "child", 2, 1, ptrace.SpanKindClient, end.Add(-time.Second), end)
+		addExceptionEvent(child, exceptionType)
+
+		metrics := convertTraces(zap.NewNop(), &config, state, traces, end)
+		datapoints := findMetric(t, "apm.service.transaction.error.class.count", getAllMetrics(metrics)).Sum().DataPoints()
+		for i := 0; i < datapoints.Len(); i++ {
+			errorClass, _ := datapoints.At(i).Attributes().Get("error.class")
+			counts[errorClass.Str()] += datapoints.At(i).IntValue()
+		}
+	}
+	assert.Equal(t, map[string]int64{"TimeoutError": 2, "Other": 1}, counts)
+}
+
+func TestConfigValidateURLNormalization(t *testing.T) {
+	assert.NoError(t, (&Config{URLNormalization: URLNormalizationConfig{
+		Rules:        []URLRewriteRule{{Match: `^/static/.*`, Replacement: "/static/*"}},
+		SegmentTerms: []SegmentTermsRule{{Prefix: "/api", Terms: []string{"users"}}},
+	}}).Validate())
+	assert.Error(t, (&Config{URLNormalization: URLNormalizationConfig{Rules: []URLRewriteRule{{Match: `(`}}}}).Validate())
+	assert.Error(t, (&Config{URLNormalization: URLNormalizationConfig{SegmentTerms: []SegmentTermsRule{{Prefix: "api"}}}}).Validate())
+}
+
+func TestConfigValidateErrorClasses(t *testing.T) {
+	assert.NoError(t, (&Config{Errors: ErrorsConfig{ClassAttribution: "first", MaxClasses: 10}}).Validate())
+	assert.Error(t, (&Config{Errors: ErrorsConfig{ClassAttribution: "last"}}).Validate())
+	assert.Error(t, (&Config{Errors: ErrorsConfig{MaxClasses: -1}}).Validate())
 }
 
 func addSpan(spanSlice ptrace.SpanSlice, attributes map[string]string, spanValues []TestSpan) {
@@ -86,22 +171,182 @@ func checkHistogramMetric(t *testing.T, name string, value float64, metrics pmet
 	}
 }
 
-// TODO: Uncomment the following when it's used again...
-//func checkSumMetric(t *testing.T, name string, value int64, metrics pmetric.MetricSlice) {
-//	t.Helper()
-//	found := false
-//
-//	for i := 0; i < metrics.Len(); i++ {
-//		m := metrics.At(i)
-//		if m.Name() == name {
-//			dp := m.Sum().DataPoints().At(0)
-//			assert.Equal(t, value, dp.IntValue())
-//			found = true
-//			break
-//		}
-//	}
-//
-//	if !found {
-//		assert.Fail(t, fmt.Sprintf("Could not find metric %s", name))
-//	}
-//}
+func checkSumMetric(t *testing.T, name string, value int64, metrics pmetric.MetricSlice) {
+	t.Helper()
+	found := false
+
+	for i := 0; i < metrics.Len(); i++ {
+		m := metrics.At(i)
+		if m.Name() == name {
+			dp := m.Sum().DataPoints().At(0)
+			assert.Equal(t, value, dp.IntValue())
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		assert.Fail(t, fmt.Sprintf("Could not find metric %s", name))
+	}
+}
+
+func checkNoMetric(t *testing.T, name string, metrics pmetric.MetricSlice) {
+	t.Helper()
+	for i := 0; i < metrics.Len(); i++ {
+		assert.NotEqual(t, name, metrics.At(i).Name())
+	}
+}
+
+func TestProcessTransactionAcrossBatches(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
+	attributeFilter := NewAttributeFilter(nil, nil)
+	end := time.Unix(1000, 0)
+	start := end.Add(-time.Second)
+	now := time.Now()
+
+	rootBatch := newTestTraces()
+	root := rootBatch.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+	setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, start, end)
+
+	childBatch := newTestTraces()
+	child := childBatch.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+	setTestSpan(child, "child", 2, 1, ptrace.SpanKindInternal, start, start.Add(400*time.Millisecond))
+
+	firstMetrics := NewMetrics()
+	transactions.AddTraces(logger, attributeFilter, firstMetrics, rootBatch, now)
+	assert.Equal(t, 0, transactions.ProcessCompletedTransactions(firstMetrics, nil, now, time.Second, time.Minute, false))
+
+	secondMetrics := NewMetrics()
+	transactions.AddTraces(logger, attributeFilter, secondMetrics, childBatch, now.Add(500*time.Millisecond))
+	assert.Equal(t, 0, transactions.ProcessCompletedTransactions(secondMetrics, nil, now.Add(500*time.Millisecond), time.Second, time.Minute, false))
+	assert.Equal(t, 1, transactions.ProcessCompletedTransactions(secondMetrics, nil, now.Add(time.Second), time.Second, time.Minute, false))
+	assert.Empty(t, transactions.Transactions)
+
+	metrics := secondMetrics.AppendOtelMetrics(pmetric.NewMetrics())
+	sm := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0)
+	checkHistogramMetric(t, "newrelic.timeslice.value", 0.4, sm.Metrics())
+	checkHistogramMetric(t, "apm.service.transaction.sampled_duration", 1, sm.Metrics())
+}
+
+func TestProcessTransactionWithoutRootAfterMaxWait(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
+	end := time.Unix(1000, 0)
+	now := time.Now()
+
+	traces := newTestTraces()
+	child := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+	setTestSpan(child, "child", 2, 1, ptrace.SpanKindInternal, end.Add(-time.Second), end)
+
+	metricMap := NewMetrics()
+	transactions.AddTraces(logger, NewAttributeFilter(nil, nil), metricMap, traces, now)
+	assert.Equal(t, 0, transactions.ProcessCompletedTransactions(metricMap, nil, now.Add(10*time.Second), time.Second, time.Minute, false))
+	assert.Equal(t, 1, transactions.ProcessCompletedTransactions(metricMap, nil, now.Add(time.Minute), time.Second, time.Minute, false))
+	assert.Empty(t, transactions.Transactions)
+}
+
+func TestMaxBufferedTransactions(t *testing.T) {
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5, MaxBufferedTransactions: 1})
+	end := time.Unix(1000, 0)
+	now := time.Now()
+
+	metricMap := NewMetrics()
+	for i := 0; i < 2; i++ {
+		traces := newTestTraces()
+		root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+		setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+		root.SetTraceID(pcommon.TraceID{byte(i + 1)})
+		transactions.AddTraces(zap.NewNop(), NewAttributeFilter(nil, nil), metricMap, traces, now.Add(time.Duration(i)*time.Second))
+	}
+
+	// the transaction buffered the longest is processed before its grace period is over
+	assert.Equal(t, 1, transactions.ProcessCompletedTransactions(metricMap, nil, now.Add(time.Second), time.Minute, time.Hour, false))
+	assert.Equal(t, 1, len(transactions.Transactions))
+	for _, transaction := range transactions.Transactions {
+		assert.Equal(t, pcommon.TraceID{2}, transaction.RootSpan.TraceID())
+	}
+	metrics := metricMap.AppendOtelMetrics(pmetric.NewMetrics())
+	sm := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0)
+	checkHistogramMetric(t, "apm.service.transaction.sampled_duration", 1, sm.Metrics())
+	evicted := 0
+	for i := 0; i < sm.Metrics().Len(); i++ {
+		if sm.Metrics().At(i).Name() == evictedTransactionsMetricName {
+			evicted += int(sm.Metrics().At(i).Sum().DataPoints().At(0).IntValue())
+		}
+	}
+	assert.Equal(t, 1, evicted)
+}
+
+func TestConnectorFlushesBufferedTransactionsOnShutdown(t *testing.T) {
+	sink := new(consumertest.MetricsSink)
+	config := &Config{ApdexT: 0.5, TransactionGracePeriod: time.Hour, TransactionMaxWait: time.Hour}
+	connector := newApmMetricConnector(config, zap.NewNop(), sink)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+
+	end := time.Unix(1000, 0)
+	traces := newTestTraces()
+	root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+	setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+
+	assert.NoError(t, connector.ConsumeTraces(context.Background(), traces))
+	assert.Empty(t, sink.AllMetrics())
+
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	assert.Len(t, sink.AllMetrics(), 1)
+	sm := sink.AllMetrics()[0].ResourceMetrics().At(0).ScopeMetrics().At(0)
+	checkHistogramMetric(t, "apm.service.transaction.sampled_duration", 1, sm.Metrics())
+}
+
+func TestConfigValidateTransactionBuffering(t *testing.T) {
+	assert.NoError(t, createDefaultConfig().(*Config).Validate())
+	assert.NoError(t, (&Config{TransactionGracePeriod: time.Second, TransactionMaxWait: time.Minute}).Validate())
+	assert.Error(t, (&Config{TransactionGracePeriod: time.Minute, TransactionMaxWait: time.Second}).Validate())
+	assert.Error(t, (&Config{TransactionGracePeriod: -time.Second}).Validate())
+	assert.Error(t, (&Config{MaxBufferedTransactions: -1}).Validate())
+	assert.Error(t, (&Config{SlowTransactions: SlowTransactionsConfig{Interval: -time.Minute}}).Validate())
+	assert.Error(t, (&Config{AggregationInterval: time.Minute, AggregationTemporality: "gauge"}).Validate())
+}
+
+func newTestTraces() ptrace.Traces {
+	traces := ptrace.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().PutStr("service.name", "service")
+	resourceSpans.Resource().Attributes().PutStr("instrumentation.provider", "newrelic-opentelemetry")
+	resourceSpans.ScopeSpans().AppendEmpty()
+	return traces
+}
+
+func setTestSpan(span ptrace.Span, name string, spanID byte, parentSpanID byte, kind ptrace.SpanKind, start time.Time, end time.Time) {
+	span.SetName(name)
+	span.SetTraceID(pcommon.TraceID{0x01})
+	span.SetSpanID(pcommon.SpanID{spanID})
+	if parentSpanID != 0 {
+		span.SetParentSpanID(pcommon.SpanID{parentSpanID})
+	}
+	span.SetKind(kind)
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(end))
+}
+
+func TestConnectorAggregatesMetricsUntilShutdown(t *testing.T) {
+	sink := new(consumertest.MetricsSink)
+	config := &Config{ApdexT: 0.5, AggregationInterval: time.Hour, AggregationTemporality: deltaTemporality}
+	connector := newApmMetricConnector(config, zap.NewNop(), sink)
+	assert.NoError(t, connector.Start(context.Background(), componenttest.NewNopHost()))
+
+	end := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		traces := newTestTraces()
+		root := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+		setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+		root.SetTraceID(pcommon.TraceID{byte(i + 1)})
+		assert.NoError(t, connector.ConsumeTraces(context.Background(), traces))
+	}
+	assert.Empty(t, sink.AllMetrics())
+
+	assert.NoError(t, connector.Shutdown(context.Background()))
+	assert.Len(t, sink.AllMetrics(), 1)
+	sm := sink.AllMetrics()[0].ResourceMetrics().At(0).ScopeMetrics().At(0)
+	checkHistogramMetric(t, "apm.service.transaction.sampled_duration", 3, sm.Metrics())
+}
@@ -6,6 +6,9 @@ package apmconnector // import "github.com/newrelic/opentelemetry-collector-comp
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/consumer"
@@ -19,6 +22,10 @@ type OpenTelemetryMetricToApmMetricConnector struct {
 	logger *zap.Logger
 
 	metricsConsumer consumer.Metrics
+	state           *connectorState
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 func (c *OpenTelemetryMetricToApmMetricConnector) Capabilities() consumer.Capabilities {
@@ -26,7 +33,7 @@ func (c *OpenTelemetryMetricToApmMetricConnector) Capabilities() consumer.Capabi
 }
 
 func (c *OpenTelemetryMetricToApmMetricConnector) ConsumeMetrics(ctx context.Context, td pmetric.Metrics) error {
-	metrics := ConvertMetrics(c.logger, c.config, td)
+	metrics := convertMetrics(c.logger, c.config, c.state, td, time.Now())
 	return c.metricsConsumer.ConsumeMetrics(ctx, metrics)
 }
 
@@ -35,18 +42,58 @@ func (c *OpenTelemetryMetricToApmMetricConnector) Start(_ context.Context, _ com
 	if c.config.ApdexT == 0 {
 		c.config.ApdexT = defaultApdexT
 	}
+	c.wg.Add(1)
+	go c.recordInstancesPeriodically()
 	return nil
 }
 
 func (c *OpenTelemetryMetricToApmMetricConnector) Shutdown(context.Context) error {
 	c.logger.Info("Stopping the APM Metric Connector")
+	close(c.done)
+	c.wg.Wait()
 	return nil
 }
 
+// recordInstancesPeriodically reports the instances that went stale, even when no metrics are received.
+func (c *OpenTelemetryMetricToApmMetricConnector) recordInstancesPeriodically() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(instanceRecordInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.recordInstances(context.Background(), time.Now()); err != nil {
+				c.logger.Error("Could not send APM metrics", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (c *OpenTelemetryMetricToApmMetricConnector) recordInstances(ctx context.Context, now time.Time) error {
+	metricMap := NewMetrics()
+	c.state.instances.Record(metricMap, now)
+	if len(metricMap) == 0 {
+		return nil
+	}
+	return c.metricsConsumer.ConsumeMetrics(ctx, metricMap.AppendOtelMetrics(pmetric.NewMetrics()))
+}
+
 func ConvertMetrics(logger *zap.Logger, config *Config, md pmetric.Metrics) pmetric.Metrics {
-	apdex := NewApdex(config.ApdexT)
+	return convertMetrics(logger, config, newConnectorState(config), md, time.Now())
+}
+
+func convertMetrics(logger *zap.Logger, config *Config, state *connectorState, md pmetric.Metrics, now time.Time) pmetric.Metrics {
+	apdexRules := NewApdexRules(config.ApdexT, config.ApdexTOverrides)
+	errorClassifier := NewErrorClassifier(config.Errors)
+	urlNormalizer := NewURLNormalizer(config.URLNormalization)
+	webTransactionNamer := func(attributes pcommon.Map) (string, TransactionType) {
+		return GetTransactionMetricNameFromAttributes(attributes, urlNormalizer)
+	}
 	newMetrics := pmetric.NewMetrics()
-	attributesFilter := NewAttributeFilter()
+	attributesFilter := NewAttributeFilter(config.ResourceAttributes.Include, config.ResourceAttributes.Exclude)
 	metricMap := NewMetrics()
 
 	for i := 0; i < md.ResourceMetrics().Len(); i++ {
@@ -54,6 +101,7 @@ func ConvertMetrics(logger *zap.Logger, config *Config, md pmetric.Metrics) pmet
 
 		rmNew := pmetric.ResourceMetrics{}
 		metrics := &ResourceMetrics{}
+		serviceName := GetServiceName(rm.Resource().Attributes())
 
 		for j := 0; j < rm.ScopeMetrics().Len(); j++ {
 			sm := rm.ScopeMetrics().At(j)
@@ -64,17 +112,24 @@ func ConvertMetrics(logger *zap.Logger, config *Config, md pmetric.Metrics) pmet
 				m := sm.Metrics().At(k)
 
 				if isResponseTimeMetric(m.Name()) {
-					rmNew, smNew, metrics = createResourceAndScopeMetrics(logger, rmNew, attributesFilter, rm, newMetrics, metrics, metricMap, smNew)
-					recordTransactionMetrics(logger, m, metrics, apdex, smNew)
+					rmNew, smNew, metrics = createResourceAndScopeMetrics(logger, rmNew, attributesFilter, state, now, rm, newMetrics, metrics, metricMap, smNew)
+					recordTransactionMetrics(logger, m, metrics, apdexRules, config.ApdexInterpolation, errorClassifier, webTransactionNamer, serviceName, smNew)
+				} else if isMessagingConsumerMetric(m.Name()) {
+					rmNew, smNew, metrics = createResourceAndScopeMetrics(logger, rmNew, attributesFilter, state, now, rm, newMetrics, metrics, metricMap, smNew)
+					recordTransactionMetrics(logger, m, metrics, apdexRules, config.ApdexInterpolation, errorClassifier, messagingTransactionNamer(m.Name()), serviceName, smNew)
 				} else if isExternalCallMetric(m.Name()) {
-					rmNew, smNew, metrics = createResourceAndScopeMetrics(logger, rmNew, attributesFilter, rm, newMetrics, metrics, metricMap, smNew)
-					recordExternalHostDurationMetric(logger, m, smNew)
+					rmNew, smNew, metrics = createResourceAndScopeMetrics(logger, rmNew, attributesFilter, state, now, rm, newMetrics, metrics, metricMap, smNew)
+					recordExternalHostDurationMetric(logger, m, metrics, smNew)
+				} else if isDatastoreMetric(m.Name()) {
+					rmNew, smNew, metrics = createResourceAndScopeMetrics(logger, rmNew, attributesFilter, state, now, rm, newMetrics, metrics, metricMap, smNew)
+					recordDatastoreDurationMetric(logger, m, metrics, smNew)
 				}
 			}
 		}
 	}
 
-	if newMetrics.ResourceMetrics().Len() > 0 {
+	state.instances.Record(metricMap, now)
+	if len(metricMap) > 0 {
 		metricMap.AppendOtelMetrics(newMetrics)
 	}
 
@@ -88,6 +143,26 @@ func isResponseTimeMetric(metricName string) bool {
 		metricName == "rpc.server.duration"
 }
 
+func isMessagingConsumerMetric(metricName string) bool {
+	return metricName == "messaging.process.duration" ||
+		metricName == "messaging.receive.duration"
+}
+
+// messagingTransactionNamer names the transactions of a messaging metric like those of consumer spans. The operation
+// defaults to the one measured by the metric.
+func messagingTransactionNamer(metricName string) func(pcommon.Map) (string, TransactionType) {
+	operation := strings.TrimSuffix(strings.TrimPrefix(metricName, "messaging."), ".duration")
+	return func(attributes pcommon.Map) (string, TransactionType) {
+		if _, key := GetFirst(attributes, messagingOperationAttributes); key == "" {
+			withOperation := pcommon.NewMap()
+			attributes.CopyTo(withOperation)
+			withOperation.PutStr("messaging.operation", operation)
+			attributes = withOperation
+		}
+		return GetConsumerTransactionMetricName(attributes)
+	}
+}
+
 func isExternalCallMetric(metricName string) bool {
 	// http.client.duration will be deprecated in the near future in favor of http.client.request.duration
 	return metricName == "http.client.request.duration" ||
@@ -95,7 +170,13 @@ func isExternalCallMetric(metricName string) bool {
 		metricName == "rpc.client.duration"
 }
 
-func recordExternalHostDurationMetric(logger *zap.Logger, m pmetric.Metric, smNew pmetric.ScopeMetrics) {
+func isDatastoreMetric(metricName string) bool {
+	// db.client.duration was emitted by instrumentations before db.client.operation.duration was specified
+	return metricName == "db.client.operation.duration" ||
+		metricName == "db.client.duration"
+}
+
+func recordExternalHostDurationMetric(logger *zap.Logger, m pmetric.Metric, metrics *ResourceMetrics, smNew pmetric.ScopeMetrics) {
 	newMetric := pmetric.NewMetric()
 	newMetric.SetName("apm.service.external.host.duration")
 	newMetric.SetDescription("Duration of external calls")
@@ -112,9 +193,11 @@ func recordExternalHostDurationMetric(logger *zap.Logger, m pmetric.Metric, smNe
 				newDp.Attributes().PutStr("server.address", serverAddress)
 				newDp.Attributes().PutStr("external.host", serverAddress)
 				newDp.Attributes().PutStr("metricTimesliceName", fmt.Sprintf("External/%s/all", serverAddress))
+				limitDataPointAttributes(metrics, newMetric.Name(), newDp.Attributes(), newDp.StartTimestamp(), newDp.Timestamp())
 			}
 		}
 		newMetric.Histogram().SetAggregationTemporality(m.Histogram().AggregationTemporality())
+		mergeDataPoints(newMetric)
 		newMetric.CopyTo(smNew.Metrics().AppendEmpty())
 	case pmetric.MetricTypeExponentialHistogram:
 		newMetric.SetEmptyExponentialHistogram().DataPoints().EnsureCapacity(3)
@@ -126,9 +209,11 @@ func recordExternalHostDurationMetric(logger *zap.Logger, m pmetric.Metric, smNe
 				newDp.Attributes().PutStr("server.address", serverAddress)
 				newDp.Attributes().PutStr("external.host", serverAddress)
 				newDp.Attributes().PutStr("metricTimesliceName", fmt.Sprintf("External/%s/all", serverAddress))
+				limitDataPointAttributes(metrics, newMetric.Name(), newDp.Attributes(), newDp.StartTimestamp(), newDp.Timestamp())
 			}
 		}
 		newMetric.ExponentialHistogram().SetAggregationTemporality(m.ExponentialHistogram().AggregationTemporality())
+		mergeDataPoints(newMetric)
 		newMetric.CopyTo(smNew.Metrics().AppendEmpty())
 	default:
 		// This should not occur. All the metrics we're deriving from should be histograms.
@@ -138,7 +223,57 @@ func recordExternalHostDurationMetric(logger *zap.Logger, m pmetric.Metric, smNe
 	}
 }
 
-func recordTransactionMetrics(logger *zap.Logger, m pmetric.Metric, metrics *ResourceMetrics, apdex Apdex, smNew pmetric.ScopeMetrics) {
+func recordDatastoreDurationMetric(logger *zap.Logger, m pmetric.Metric, metrics *ResourceMetrics, smNew pmetric.ScopeMetrics) {
+	newMetric := pmetric.NewMetric()
+	newMetric.SetName("apm.service.datastore.operation.duration")
+	newMetric.SetDescription("Duration of database calls")
+	newMetric.SetUnit(m.Unit())
+
+	switch metricType := m.Type(); metricType {
+	case pmetric.MetricTypeHistogram:
+		newMetric.SetEmptyHistogram().DataPoints().EnsureCapacity(3)
+		for i := 0; i < m.Histogram().DataPoints().Len(); i++ {
+			dp := m.Histogram().DataPoints().At(i)
+			if attributes, timesliceName, isDatastore := GetDatastoreAttributes(dp.Attributes()); isDatastore {
+				newDp := newMetric.Histogram().DataPoints().AppendEmpty()
+				dp.CopyTo(newDp)
+				attributes.CopyTo(newDp.Attributes())
+				newDp.Attributes().PutStr("metricTimesliceName", timesliceName)
+				limitDataPointAttributes(metrics, newMetric.Name(), newDp.Attributes(), newDp.StartTimestamp(), newDp.Timestamp())
+			}
+		}
+		newMetric.Histogram().SetAggregationTemporality(m.Histogram().AggregationTemporality())
+		// datapoints that only differed by the attributes that were not kept are the same series
+		mergeDataPoints(newMetric)
+		newMetric.CopyTo(smNew.Metrics().AppendEmpty())
+	case pmetric.MetricTypeExponentialHistogram:
+		newMetric.SetEmptyExponentialHistogram().DataPoints().EnsureCapacity(3)
+		for i := 0; i < m.ExponentialHistogram().DataPoints().Len(); i++ {
+			dp := m.ExponentialHistogram().DataPoints().At(i)
+			if attributes, timesliceName, isDatastore := GetDatastoreAttributes(dp.Attributes()); isDatastore {
+				newDp := newMetric.ExponentialHistogram().DataPoints().AppendEmpty()
+				dp.CopyTo(newDp)
+				attributes.CopyTo(newDp.Attributes())
+				newDp.Attributes().PutStr("metricTimesliceName", timesliceName)
+				limitDataPointAttributes(metrics, newMetric.Name(), newDp.Attributes(), newDp.StartTimestamp(), newDp.Timestamp())
+			}
+		}
+		newMetric.ExponentialHistogram().SetAggregationTemporality(m.ExponentialHistogram().AggregationTemporality())
+		mergeDataPoints(newMetric)
+		newMetric.CopyTo(smNew.Metrics().AppendEmpty())
+	default:
+		// This should not occur. All the metrics we're deriving from should be histograms.
+		// db.client.operation.duration: https://github.com/open-telemetry/semantic-conventions/blob/main/docs/database/database-metrics.md#metric-dbclientoperationduration
+		logger.Error("unexpected metric type", zap.String("name", m.Name()), zap.String("type", metricType.String()))
+	}
+}
+
+func recordTransactionMetrics(logger *zap.Logger, m pmetric.Metric, metrics *ResourceMetrics, apdexRules ApdexRules, interpolateApdex bool,
+	errorClassifier *ErrorClassifier, transactionNamer func(pcommon.Map) (string, TransactionType), serviceName string, smNew pmetric.ScopeMetrics) {
+	if !IsDurationUnit(m.Unit()) {
+		logger.Debug("Apdex can not be computed, unsupported unit", zap.String("name", m.Name()), zap.String("unit", m.Unit()))
+	}
+
 	newMetric := pmetric.NewMetric()
 	newMetric.SetName("apm.service.transaction.duration")
 	newMetric.SetDescription("Duration of the transaction")
@@ -151,46 +286,30 @@ func recordTransactionMetrics(logger *zap.Logger, m pmetric.Metric, metrics *Res
 			dp := m.Histogram().DataPoints().At(i)
 			newDp := newMetric.Histogram().DataPoints().AppendEmpty()
 			dp.CopyTo(newDp)
-			name, txType := GetTransactionMetricNameFromAttributes(dp.Attributes())
+			name, txType := transactionNamer(dp.Attributes())
+			apdex := apdexRules.GetApdex(serviceName, name)
 			newDp.Attributes().Clear()
 			newDp.Attributes().PutStr("transactionType", txType.AsString())
 			newDp.Attributes().PutStr("transactionName", name)
 			newDp.Attributes().PutStr("metricTimesliceName", name)
-
-			isError := ContainsErrorHTTPStatusCode(dp.Attributes())
-			if isError {
-				{
-					attributes := pcommon.NewMap()
-					attributes.PutStr("transactionType", txType.AsString())
-					sum := metrics.GetSum("apm.service.error.count", attributes, true, dp.StartTimestamp(), dp.Timestamp())
-					sum.Add(int64(newDp.Count()), dp.StartTimestamp(), dp.Timestamp())
-				}
-				{
-					attributes := pcommon.NewMap()
-					attributes.PutStr("transactionType", txType.AsString())
-					attributes.PutStr("transactionName", name)
-					sum := metrics.GetSum("apm.service.transaction.error.count", attributes, true, dp.StartTimestamp(), dp.Timestamp())
-					sum.Add(int64(newDp.Count()), dp.StartTimestamp(), dp.Timestamp())
-				}
-
-				generateApdexMetrics(apdex, "F", metrics, dp.StartTimestamp(), dp.Timestamp(), int64(dp.Count()), name)
+			limitDataPointAttributes(metrics, newMetric.Name(), newDp.Attributes(), newDp.StartTimestamp(), newDp.Timestamp())
+			// the other metrics of the datapoint are recorded with the same transaction name, even once it overflowed
+			limitedName, _ := newDp.Attributes().Get("transactionName")
+			name = limitedName.Str()
+
+			errorKind := errorClassifier.ClassifyAttributes(dp.Attributes())
+			if errorKind != NotAnError {
+				recordErrorCounts(metrics, errorKind, name, txType, dp.StartTimestamp(), dp.Timestamp(), int64(newDp.Count()))
+			}
+			if errorKind == Error {
+				generateApdexMetrics(apdex, "F", metrics, dp.StartTimestamp(), dp.Timestamp(), int64(dp.Count()), name, txType)
 			} else {
-				s, t, f := GetApdexFromExplicitHistogramBounds(newDp.ExplicitBounds().AsRaw(), newDp.BucketCounts().AsRaw(), m.Unit(), apdex)
-
-				if s > 0 {
-					generateApdexMetrics(apdex, "S", metrics, dp.StartTimestamp(), dp.Timestamp(), int64(s), name)
-				}
-
-				if t > 0 {
-					generateApdexMetrics(apdex, "T", metrics, dp.StartTimestamp(), dp.Timestamp(), int64(t), name)
-				}
-
-				if f > 0 {
-					generateApdexMetrics(apdex, "F", metrics, dp.StartTimestamp(), dp.Timestamp(), int64(f), name)
-				}
+				s, t, f := GetApdexFromExplicitHistogramBounds(newDp.ExplicitBounds().AsRaw(), newDp.BucketCounts().AsRaw(), m.Unit(), apdex, interpolateApdex)
+				generateApdexZoneMetrics(apdex, s, t, f, metrics, dp.StartTimestamp(), dp.Timestamp(), name, txType)
 			}
 		}
 		newMetric.Histogram().SetAggregationTemporality(m.Histogram().AggregationTemporality())
+		mergeDataPoints(newMetric)
 		newMetric.CopyTo(smNew.Metrics().AppendEmpty())
 	case pmetric.MetricTypeExponentialHistogram:
 		newMetric.SetEmptyExponentialHistogram().DataPoints().EnsureCapacity(3)
@@ -198,34 +317,31 @@ func recordTransactionMetrics(logger *zap.Logger, m pmetric.Metric, metrics *Res
 			dp := m.ExponentialHistogram().DataPoints().At(i)
 			newDp := newMetric.ExponentialHistogram().DataPoints().AppendEmpty()
 			dp.CopyTo(newDp)
-			name, txType := GetTransactionMetricNameFromAttributes(dp.Attributes())
+			name, txType := transactionNamer(dp.Attributes())
+			apdex := apdexRules.GetApdex(serviceName, name)
 			newDp.Attributes().Clear()
 			newDp.Attributes().PutStr("transactionType", txType.AsString())
 			newDp.Attributes().PutStr("transactionName", name)
 			newDp.Attributes().PutStr("metricTimesliceName", name)
-
-			isError := ContainsErrorHTTPStatusCode(dp.Attributes())
-			if isError {
-				{
-					attributes := pcommon.NewMap()
-					attributes.PutStr("transactionType", txType.AsString())
-					sum := metrics.GetSum("apm.service.error.count", attributes, true, dp.StartTimestamp(), dp.Timestamp())
-					sum.Add(int64(newDp.Count()), dp.StartTimestamp(), dp.Timestamp())
-				}
-				{
-					attributes := pcommon.NewMap()
-					attributes.PutStr("transactionType", txType.AsString())
-					attributes.PutStr("transactionName", name)
-					sum := metrics.GetSum("apm.service.transaction.error.count", attributes, true, dp.StartTimestamp(), dp.Timestamp())
-					sum.Add(int64(newDp.Count()), dp.StartTimestamp(), dp.Timestamp())
-				}
-
-				generateApdexMetrics(apdex, "F", metrics, dp.StartTimestamp(), dp.Timestamp(), int64(dp.Count()), name)
+			limitDataPointAttributes(metrics, newMetric.Name(), newDp.Attributes(), newDp.StartTimestamp(), newDp.Timestamp())
+			// the other metrics of the datapoint are recorded with the same transaction name, even once it overflowed
+			limitedName, _ := newDp.Attributes().Get("transactionName")
+			name = limitedName.Str()
+
+			errorKind := errorClassifier.ClassifyAttributes(dp.Attributes())
+			if errorKind != NotAnError {
+				recordErrorCounts(metrics, errorKind, name, txType, dp.StartTimestamp(), dp.Timestamp(), int64(newDp.Count()))
+			}
+			if errorKind == Error {
+				generateApdexMetrics(apdex, "F", metrics, dp.StartTimestamp(), dp.Timestamp(), int64(dp.Count()), name, txType)
+			} else {
+				s, t, f := GetApdexFromExponentialHistogram(newDp.Scale(), newDp.ZeroCount(), newDp.Positive().Offset(),
+					newDp.Positive().BucketCounts().AsRaw(), newDp.Negative().BucketCounts().AsRaw(), m.Unit(), apdex, interpolateApdex)
+				generateApdexZoneMetrics(apdex, s, t, f, metrics, dp.StartTimestamp(), dp.Timestamp(), name, txType)
 			}
-
-			// TODO: Generate apdex metrics for exponential histograms.
 		}
 		newMetric.ExponentialHistogram().SetAggregationTemporality(m.ExponentialHistogram().AggregationTemporality())
+		mergeDataPoints(newMetric)
 		newMetric.CopyTo(smNew.Metrics().AppendEmpty())
 	default:
 		// This should not occur. All the metrics we're deriving from should be histograms.
@@ -235,7 +351,7 @@ func recordTransactionMetrics(logger *zap.Logger, m pmetric.Metric, metrics *Res
 	}
 }
 
-func createResourceAndScopeMetrics(logger *zap.Logger, rmNew pmetric.ResourceMetrics, attributesFilter *AttributeFilter, rm pmetric.ResourceMetrics, newMetrics pmetric.Metrics, metrics *ResourceMetrics, metricMap Metrics, smNew pmetric.ScopeMetrics) (pmetric.ResourceMetrics, pmetric.ScopeMetrics, *ResourceMetrics) {
+func createResourceAndScopeMetrics(logger *zap.Logger, rmNew pmetric.ResourceMetrics, attributesFilter *AttributeFilter, state *connectorState, now time.Time, rm pmetric.ResourceMetrics, newMetrics pmetric.Metrics, metrics *ResourceMetrics, metricMap Metrics, smNew pmetric.ScopeMetrics) (pmetric.ResourceMetrics, pmetric.ScopeMetrics, *ResourceMetrics) {
 	if rmNew == (pmetric.ResourceMetrics{}) {
 		resourceAttributes, err := attributesFilter.FilterAttributes(rm.Resource().Attributes())
 		if err != nil {
@@ -247,7 +363,8 @@ func createResourceAndScopeMetrics(logger *zap.Logger, rmNew pmetric.ResourceMet
 		// TODO: should we declare a New Relic specific schema?
 		// rmNew.SetSchemaUrl(rm.SchemaUrl())
 
-		metrics = metricMap.GetOrCreateResource(resourceAttributes)
+		metrics = metricMap.GetOrCreateLimitedResource(resourceAttributes, state.cardinalityLimits)
+		state.instances.Observe(rm.Resource().Attributes(), resourceAttributes, now)
 	}
 
 	if smNew == (pmetric.ScopeMetrics{}) {
@@ -261,11 +378,55 @@ func createResourceAndScopeMetrics(logger *zap.Logger, rmNew pmetric.ResourceMet
 	return rmNew, smNew, metrics
 }
 
-func generateApdexMetrics(apdex Apdex, zone string, resourceMetrics *ResourceMetrics, startTimestamp pcommon.Timestamp, timestamp pcommon.Timestamp, count int64, transactionName string) {
+// limitDataPointAttributes replaces the attributes of a datapoint with those of the overflow series once its metric
+// has reached its limit, as for the metrics recorded by the connector.
+func limitDataPointAttributes(metrics *ResourceMetrics, metricName string, attributes pcommon.Map, startTimestamp pcommon.Timestamp, timestamp pcommon.Timestamp) {
+	if limited := metrics.limitAttributes(metricName, attributes, startTimestamp, timestamp); limited != attributes {
+		limited.CopyTo(attributes)
+	}
+}
+
+// recordErrorCounts counts errors, or expected errors, for the service and the transaction.
+func recordErrorCounts(resourceMetrics *ResourceMetrics, errorKind ErrorKind, transactionName string, transactionType TransactionType,
+	startTimestamp pcommon.Timestamp, timestamp pcommon.Timestamp, count int64) {
+	serviceMetricName, transactionMetricName := "apm.service.error.count", "apm.service.transaction.error.count"
+	if errorKind == ExpectedError {
+		serviceMetricName, transactionMetricName = "apm.service.error.expected.count", "apm.service.transaction.error.expected.count"
+	}
+	{
+		attributes := pcommon.NewMap()
+		attributes.PutStr("transactionType", transactionType.AsString())
+		sum := resourceMetrics.GetSum(serviceMetricName, attributes, true, startTimestamp, timestamp)
+		sum.Add(count, startTimestamp, timestamp)
+	}
+	{
+		attributes := pcommon.NewMap()
+		attributes.PutStr("transactionType", transactionType.AsString())
+		attributes.PutStr("transactionName", transactionName)
+		sum := resourceMetrics.GetSum(transactionMetricName, attributes, true, startTimestamp, timestamp)
+		sum.Add(count, startTimestamp, timestamp)
+	}
+}
+
+func generateApdexZoneMetrics(apdex Apdex, s uint64, t uint64, f uint64, resourceMetrics *ResourceMetrics, startTimestamp pcommon.Timestamp, timestamp pcommon.Timestamp, transactionName string, transactionType TransactionType) {
+	if s > 0 {
+		generateApdexMetrics(apdex, "S", resourceMetrics, startTimestamp, timestamp, int64(s), transactionName, transactionType)
+	}
+
+	if t > 0 {
+		generateApdexMetrics(apdex, "T", resourceMetrics, startTimestamp, timestamp, int64(t), transactionName, transactionType)
+	}
+
+	if f > 0 {
+		generateApdexMetrics(apdex, "F", resourceMetrics, startTimestamp, timestamp, int64(f), transactionName, transactionType)
+	}
+}
+
+func generateApdexMetrics(apdex Apdex, zone string, resourceMetrics *ResourceMetrics, startTimestamp pcommon.Timestamp, timestamp pcommon.Timestamp, count int64, transactionName string, transactionType TransactionType) {
 	attributes := pcommon.NewMap()
 	attributes.PutDouble("apdex.value", apdex.apdexSatisfying)
 	attributes.PutStr("apdex.zone", zone)
-	attributes.PutStr("transactionType", WebTransactionType.AsString())
+	attributes.PutStr("transactionType", transactionType.AsString())
 
 	apdexMetric := resourceMetrics.GetSum("apm.service.apdex", attributes, true, startTimestamp, timestamp)
 	apdexMetric.Add(count, startTimestamp, timestamp)
@@ -0,0 +1,279 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+)
+
+func TestConvertMetricsApdexOverride(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "search")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("http.server.duration")
+	histogram.SetUnit("s")
+	dp := histogram.SetEmptyHistogram().DataPoints().AppendEmpty()
+	dp.Attributes().PutStr("http.route", "/api/search")
+	dp.Attributes().PutStr("http.method", "GET")
+	dp.ExplicitBounds().FromRaw([]float64{0.5, 1, 2.5})
+	dp.BucketCounts().FromRaw([]uint64{1, 2, 3, 4})
+	dp.SetCount(10)
+
+	config := &Config{ApdexT: 0.5, ApdexTOverrides: []ApdexTOverride{{ServiceName: "search", TransactionName: "WebTransaction/http.route/api/search*", ApdexT: 1}}}
+	converted := ConvertMetrics(zap.NewNop(), config, metrics)
+
+	zones := getApdexZones(t, "apm.service.transaction.apdex", converted)
+	assert.Equal(t, map[string]int64{"S": 3, "T": 3, "F": 4}, zones)
+}
+
+func getApdexZones(t *testing.T, metricName string, metrics pmetric.Metrics) map[string]int64 {
+	t.Helper()
+	zones := make(map[string]int64)
+	for i := 0; i < metrics.ResourceMetrics().Len(); i++ {
+		sms := metrics.ResourceMetrics().At(i).ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			ms := sms.At(j).Metrics()
+			for k := 0; k < ms.Len(); k++ {
+				if ms.At(k).Name() != metricName {
+					continue
+				}
+				dps := ms.At(k).Sum().DataPoints()
+				for l := 0; l < dps.Len(); l++ {
+					zone, _ := dps.At(l).Attributes().Get("apdex.zone")
+					zones[zone.Str()] += dps.At(l).IntValue()
+				}
+			}
+		}
+	}
+	return zones
+}
+
+func TestConvertMetricsExponentialHistogramApdex(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "search")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("http.server.request.duration")
+	histogram.SetUnit("s")
+	dp := histogram.SetEmptyExponentialHistogram().DataPoints().AppendEmpty()
+	dp.Attributes().PutStr("http.route", "/api/search")
+	dp.SetScale(0)
+	dp.SetZeroCount(1)
+	// buckets: (1/4, 1/2], (1/2, 1], (1, 2], (2, 4], (4, 8]
+	dp.Positive().SetOffset(-2)
+	dp.Positive().BucketCounts().FromRaw([]uint64{1, 2, 3, 4, 5})
+	dp.SetCount(16)
+
+	converted := ConvertMetrics(zap.NewNop(), &Config{ApdexT: 0.5}, metrics)
+
+	zones := getApdexZones(t, "apm.service.apdex", converted)
+	assert.Equal(t, map[string]int64{"S": 2, "T": 5, "F": 9}, zones)
+}
+
+func TestConvertMetricsExpectedErrors(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "cart")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("http.server.request.duration")
+	histogram.SetUnit("s")
+	dps := histogram.SetEmptyHistogram().DataPoints()
+	for _, statusCode := range []int64{404, 500} {
+		dp := dps.AppendEmpty()
+		dp.Attributes().PutStr("http.route", "/api/cart")
+		dp.Attributes().PutInt("http.response.status_code", statusCode)
+		dp.ExplicitBounds().FromRaw([]float64{0.5})
+		dp.BucketCounts().FromRaw([]uint64{3, 0})
+		dp.SetCount(3)
+	}
+
+	config := &Config{ApdexT: 0.5, Errors: ErrorsConfig{
+		ErrorMatchConfig: ErrorMatchConfig{HTTPStatusCodes: []string{"400-599"}},
+		Expected:         ErrorMatchConfig{HTTPStatusCodes: []string{"404"}},
+	}}
+	converted := ConvertMetrics(zap.NewNop(), config, metrics)
+	allMetrics := getAllMetrics(converted)
+
+	checkSumMetric(t, "apm.service.error.count", 3, allMetrics)
+	checkSumMetric(t, "apm.service.error.expected.count", 3, allMetrics)
+	checkSumMetric(t, "apm.service.transaction.error.expected.count", 3, allMetrics)
+	assert.Equal(t, map[string]int64{"S": 3, "F": 3}, getApdexZones(t, "apm.service.apdex", converted))
+}
+
+func TestConvertMetricsNormalizesURLPaths(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "users")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("http.server.duration")
+	histogram.SetUnit("s")
+	dp := histogram.SetEmptyHistogram().DataPoints().AppendEmpty()
+	dp.Attributes().PutStr("http.target", "/api/acme/users/83412?details=true")
+	dp.Attributes().PutStr("http.method", "GET")
+	dp.ExplicitBounds().FromRaw([]float64{0.5})
+	dp.BucketCounts().FromRaw([]uint64{1, 0})
+	dp.SetCount(1)
+
+	config := &Config{ApdexT: 0.5, URLNormalization: URLNormalizationConfig{
+		SegmentTerms: []SegmentTermsRule{{Prefix: "/api", Terms: []string{"users"}}},
+	}}
+	converted := ConvertMetrics(zap.NewNop(), config, metrics)
+
+	duration := findMetric(t, "apm.service.transaction.duration", getAllMetrics(converted))
+	name, _ := duration.Histogram().DataPoints().At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "WebTransaction/Uri/api/*/users/* (GET)", name.Str())
+}
+
+func TestConvertMetricsDatastoreDuration(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "orders")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("db.client.operation.duration")
+	histogram.SetUnit("s")
+	dps := histogram.SetEmptyHistogram().DataPoints()
+	dp := dps.AppendEmpty()
+	dp.Attributes().PutStr("db.system", "postgresql")
+	dp.Attributes().PutStr("db.operation.name", "SELECT")
+	dp.Attributes().PutStr("db.collection.name", "orders")
+	dp.Attributes().PutStr("server.address", "db.example.com")
+	dp.Attributes().PutStr("error.type", "timeout")
+	dp.ExplicitBounds().FromRaw([]float64{0.1, 1})
+	dp.BucketCounts().FromRaw([]uint64{1, 3, 0})
+	dp.SetCount(4)
+	// the same series once the attributes that are not kept are dropped
+	successful := dps.AppendEmpty()
+	dp.CopyTo(successful)
+	successful.Attributes().Remove("error.type")
+	successful.Attributes().PutStr("db.namespace", "shop")
+	successful.BucketCounts().FromRaw([]uint64{2, 0, 1})
+	successful.SetCount(3)
+	// the operation is required, as for spans
+	dps.AppendEmpty().Attributes().PutStr("db.system", "redis")
+
+	converted := ConvertMetrics(zap.NewNop(), &Config{ApdexT: 0.5}, metrics)
+
+	duration := findMetric(t, "apm.service.datastore.operation.duration", getAllMetrics(converted))
+	assert.Equal(t, 1, duration.Histogram().DataPoints().Len())
+	assert.Equal(t, uint64(7), duration.Histogram().DataPoints().At(0).Count())
+	assert.Equal(t, []uint64{3, 3, 1}, duration.Histogram().DataPoints().At(0).BucketCounts().AsRaw())
+	assert.Equal(t, map[string]any{
+		"db.system":           "postgresql",
+		"db.operation":        "SELECT",
+		"db.sql.table":        "orders",
+		"server.address":      "db.example.com",
+		"metricTimesliceName": "Datastore/statement/postgresql/orders/SELECT",
+	}, duration.Histogram().DataPoints().At(0).Attributes().AsRaw())
+}
+
+func TestConvertMetricsMessagingConsumerTransactions(t *testing.T) {
+	metrics := pmetric.NewMetrics()
+	rm := metrics.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "worker")
+	histogram := rm.ScopeMetrics().AppendEmpty().Metrics().AppendEmpty()
+	histogram.SetName("messaging.process.duration")
+	histogram.SetUnit("s")
+	dps := histogram.SetEmptyHistogram().DataPoints()
+	for _, failed := range []bool{false, true} {
+		dp := dps.AppendEmpty()
+		dp.Attributes().PutStr("messaging.system", "kafka")
+		dp.Attributes().PutStr("messaging.destination.name", "orders")
+		if failed {
+			dp.Attributes().PutStr("error.type", "java.lang.IllegalStateException")
+		}
+		dp.ExplicitBounds().FromRaw([]float64{0.5})
+		dp.BucketCounts().FromRaw([]uint64{2, 0})
+		dp.SetCount(2)
+	}
+
+	converted := ConvertMetrics(zap.NewNop(), &Config{ApdexT: 0.5}, metrics)
+	allMetrics := getAllMetrics(converted)
+
+	duration := findMetric(t, "apm.service.transaction.duration", allMetrics)
+	// successful and failed messages are the same series
+	assert.Equal(t, 1, duration.Histogram().DataPoints().Len())
+	assert.Equal(t, uint64(4), duration.Histogram().DataPoints().At(0).Count())
+	assert.Equal(t, map[string]any{
+		"transactionType":     "Other",
+		"transactionName":     "OtherTransaction/Consumer/kafka/orders/process",
+		"metricTimesliceName": "OtherTransaction/Consumer/kafka/orders/process",
+	}, duration.Histogram().DataPoints().At(0).Attributes().AsRaw())
+	checkSumMetric(t, "apm.service.error.count", 2, allMetrics)
+	assert.Equal(t, map[string]int64{"S": 2, "F": 2}, getApdexZones(t, "apm.service.transaction.apdex", converted))
+	apdex := findMetric(t, "apm.service.apdex", allMetrics)
+	transactionType, _ := apdex.Sum().DataPoints().At(0).Attributes().Get("transactionType")
+	assert.Equal(t, "Other", transactionType.Str())
+}
+
+func getAllMetrics(metrics pmetric.Metrics) pmetric.MetricSlice {
+	allMetrics := pmetric.NewMetricSlice()
+	for i := 0; i < metrics.ResourceMetrics().Len(); i++ {
+		sms := metrics.ResourceMetrics().At(i).ScopeMetrics()
+		for j := 0; j < sms.Len(); j++ {
+			for k := 0; k < sms.At(j).Metrics().Len(); k++ {
+				sms.At(j).Metrics().At(k).CopyTo(allMetrics.AppendEmpty())
+			}
+		}
+	}
+	return allMetrics
+}
+
+func TestMergeExponentialHistogramDataPoints(t *testing.T) {
+	dst := pmetric.NewExponentialHistogramDataPoint()
+	dst.SetScale(1)
+	dst.Positive().SetOffset(3)
+	dst.Positive().BucketCounts().FromRaw([]uint64{1, 2, 3})
+	dst.SetCount(6)
+	dst.SetMin(1.5)
+	src := pmetric.NewExponentialHistogramDataPoint()
+	src.SetScale(0)
+	src.Positive().SetOffset(0)
+	src.Positive().BucketCounts().FromRaw([]uint64{4})
+	src.SetZeroCount(1)
+	src.SetCount(5)
+	src.SetMin(0)
+
+	mergeExponentialHistogramDataPoints(dst, src)
+
+	// at scale 0, the buckets 3, 4 and 5 of scale 1 are the buckets 1, 2 and 2
+	assert.Equal(t, int32(0), dst.Scale())
+	assert.Equal(t, int32(0), dst.Positive().Offset())
+	assert.Equal(t, []uint64{4, 1, 5}, dst.Positive().BucketCounts().AsRaw())
+	assert.Equal(t, uint64(1), dst.ZeroCount())
+	assert.Equal(t, uint64(11), dst.Count())
+	assert.Equal(t, 0.0, dst.Min())
+}
+
+func TestMergeHistogramDataPointsSkipsMalformedBuckets(t *testing.T) {
+	appendDataPoint := func(dps pmetric.HistogramDataPointSlice, bounds []float64, counts []uint64) {
+		dp := dps.AppendEmpty()
+		dp.ExplicitBounds().FromRaw(bounds)
+		dp.BucketCounts().FromRaw(counts)
+		dp.SetCount(uint64(len(counts)))
+	}
+
+	// the malformed datapoint, with more buckets than its bounds allow, is skipped whether it comes first or not
+	for _, malformedFirst := range []bool{false, true} {
+		metric := pmetric.NewMetric()
+		dps := metric.SetEmptyHistogram().DataPoints()
+		if malformedFirst {
+			appendDataPoint(dps, []float64{1}, []uint64{1, 2, 3, 4})
+		}
+		appendDataPoint(dps, []float64{1, 2}, []uint64{1, 2, 3})
+		if !malformedFirst {
+			appendDataPoint(dps, []float64{1}, []uint64{1, 2, 3, 4})
+		}
+
+		mergeDataPoints(metric)
+		assert.Equal(t, 1, dps.Len())
+		assert.Equal(t, []float64{1, 2}, dps.At(0).ExplicitBounds().AsRaw())
+		assert.Equal(t, []uint64{1, 2, 3}, dps.At(0).BucketCounts().AsRaw())
+		assert.Equal(t, uint64(3), dps.At(0).Count())
+	}
+}
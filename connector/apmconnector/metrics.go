@@ -7,6 +7,7 @@ import (
 	"crypto"
 	"fmt"
 	"sort"
+	"time"
 
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/pmetric"
@@ -18,6 +19,7 @@ import (
 // into OTEL metrics
 // The map roughly follows the structure of an OTEL resource metrics:
 // resource -> scope -> metric -> datapoints
+// Nothing is recorded in nil Metrics, as when a connector only produces logs.
 
 type Metrics map[string]*ResourceMetrics
 
@@ -26,6 +28,13 @@ func NewMetrics() Metrics {
 }
 
 func (metrics *Metrics) AppendOtelMetrics(dest pmetric.Metrics) pmetric.Metrics {
+	return metrics.appendOtelMetrics(dest, pmetric.AggregationTemporalityUnspecified)
+}
+
+// appendOtelMetrics converts the map into OTEL metrics. When the temporality is
+// unspecified, histograms are reported as delta and sums as delta when monotonic,
+// cumulative otherwise.
+func (metrics *Metrics) appendOtelMetrics(dest pmetric.Metrics, temporality pmetric.AggregationTemporality) pmetric.Metrics {
 	otelMetrics := dest
 	for _, rm := range *metrics {
 		resourceMetrics := otelMetrics.ResourceMetrics().AppendEmpty()
@@ -34,21 +43,25 @@ func (metrics *Metrics) AppendOtelMetrics(dest pmetric.Metrics) pmetric.Metrics
 			scopeMetrics := resourceMetrics.ScopeMetrics().AppendEmpty()
 			sm.origin.CopyTo(scopeMetrics.Scope())
 			for _, m := range sm.metrics {
-				addMetricToScope(*m, scopeMetrics)
+				addMetricToScope(*m, scopeMetrics, temporality)
 			}
 		}
 	}
 	return otelMetrics
 }
 
-func addMetricToScope(metric Metric, scopeMetrics pmetric.ScopeMetrics) {
+func addMetricToScope(metric Metric, scopeMetrics pmetric.ScopeMetrics, temporality pmetric.AggregationTemporality) {
 	otelMetric := scopeMetrics.Metrics().AppendEmpty()
 	otelMetric.SetName(metric.metricName)
 	otelMetric.SetUnit(metric.unit)
+	otelMetric.SetDescription(metric.description)
 
 	if len(metric.histogramDatapoints) > 0 {
 		histogram := otelMetric.SetEmptyExponentialHistogram()
 		histogram.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+		if temporality != pmetric.AggregationTemporalityUnspecified {
+			histogram.SetAggregationTemporality(temporality)
+		}
 		otelDatapoints := histogram.DataPoints()
 		for _, dp := range metric.histogramDatapoints {
 			histoDp := otelDatapoints.AppendEmpty()
@@ -59,6 +72,20 @@ func addMetricToScope(metric Metric, scopeMetrics pmetric.ScopeMetrics) {
 		}
 	}
 
+	if len(metric.gaugeDatapoints) > 0 {
+		otelDatapoints := otelMetric.SetEmptyGauge().DataPoints()
+		for _, dp := range metric.gaugeDatapoints {
+			gaugeDp := otelDatapoints.AppendEmpty()
+			gaugeDp.SetTimestamp(dp.timestamp)
+			dp.attributes.CopyTo(gaugeDp.Attributes())
+			if dp.stale {
+				gaugeDp.SetFlags(pmetric.DefaultDataPointFlags.WithNoRecordedValue(true))
+			} else {
+				gaugeDp.SetIntValue(dp.value)
+			}
+		}
+	}
+
 	if len(metric.sumDatapoints) > 0 {
 		sum := otelMetric.SetEmptySum()
 		sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
@@ -70,6 +97,9 @@ func addMetricToScope(metric Metric, scopeMetrics pmetric.ScopeMetrics) {
 				sum.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
 				sum.SetIsMonotonic(true)
 			}
+			if temporality != pmetric.AggregationTemporalityUnspecified {
+				sum.SetAggregationTemporality(temporality)
+			}
 			sumDp := otelDatapoints.AppendEmpty()
 			sumDp.SetTimestamp(dp.timestamp)
 			sumDp.SetStartTimestamp(dp.startTimestamp)
@@ -80,12 +110,16 @@ func addMetricToScope(metric Metric, scopeMetrics pmetric.ScopeMetrics) {
 }
 
 func (metrics *Metrics) GetOrCreateResource(attributes pcommon.Map) *ResourceMetrics {
+	if *metrics == nil {
+		return &ResourceMetrics{attributes: attributes, discard: true}
+	}
 	key := getKeyFromMap(attributes)
 	res, resourcePresent := (*metrics)[key]
 	if resourcePresent {
 		return res
 	}
 	res = &ResourceMetrics{
+		key:          key,
 		attributes:   attributes,
 		scopeMetrics: make(map[string]*ScopeMetrics),
 	}
@@ -93,9 +127,21 @@ func (metrics *Metrics) GetOrCreateResource(attributes pcommon.Map) *ResourceMet
 	return res
 }
 
+// GetOrCreateLimitedResource is GetOrCreateResource for a resource whose metrics are subject to cardinality limits.
+func (metrics *Metrics) GetOrCreateLimitedResource(attributes pcommon.Map, limits *CardinalityLimits) *ResourceMetrics {
+	res := metrics.GetOrCreateResource(attributes)
+	res.limits = limits
+	return res
+}
+
 type ResourceMetrics struct {
+	key          string
 	attributes   pcommon.Map
 	scopeMetrics map[string]*ScopeMetrics
+	// nil when the number of series is not limited
+	limits *CardinalityLimits
+	// true when the metrics of the resource are not recorded
+	discard bool
 }
 
 func (rm *ResourceMetrics) GetOrCreateScope(scope pcommon.InstrumentationScope) *ScopeMetrics {
@@ -113,10 +159,14 @@ func (rm *ResourceMetrics) GetOrCreateScope(scope pcommon.InstrumentationScope)
 }
 
 func (rm *ResourceMetrics) AddHistogram(metricName string, attributes pcommon.Map, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp, durationNanos int64) {
+	if rm.discard {
+		return
+	}
 	// FIXME - provide a scope?
 	scopeMetrics := rm.GetOrCreateScope(pcommon.NewInstrumentationScope())
 	metric := scopeMetrics.GetOrCreateMetric(metricName)
 	metric.unit = "s"
+	attributes = rm.limitAttributes(metricName, attributes, startTimestamp, endTimestamp)
 	metric.AddHistogramDatapoint(attributes, startTimestamp, endTimestamp, NanosToSeconds(durationNanos))
 }
 
@@ -124,19 +174,49 @@ func (rm *ResourceMetrics) AddHistogramFromSpan(metricName string, attributes pc
 	rm.AddHistogram(metricName, attributes, span.StartTimestamp(), span.EndTimestamp(), (span.EndTimestamp() - span.StartTimestamp()).AsTime().UnixNano())
 }
 
-func (rm *ResourceMetrics) IncrementSum(metricName string, attributes pcommon.Map, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) {
-	scopeMetrics := rm.GetOrCreateScope(pcommon.NewInstrumentationScope())
-	metric := scopeMetrics.GetOrCreateMetric(metricName)
-	sum := metric.GetSum(attributes, false, startTimestamp, endTimestamp)
-	sum.Add(1, startTimestamp, endTimestamp)
+// IncrementMonotonicSum increments a counter, reported with a delta temporality like the counters derived from metrics.
+func (rm *ResourceMetrics) IncrementMonotonicSum(metricName string, attributes pcommon.Map, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) {
+	rm.GetSum(metricName, attributes, true, startTimestamp, endTimestamp).Add(1, startTimestamp, endTimestamp)
 }
 
 func (rm *ResourceMetrics) GetSum(metricName string, attributes pcommon.Map, isMonotonic bool, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) *SumDatapoint {
+	if rm.discard {
+		return &SumDatapoint{attributes: attributes, isMonotonic: isMonotonic}
+	}
 	scopeMetrics := rm.GetOrCreateScope(pcommon.NewInstrumentationScope())
 	metric := scopeMetrics.GetOrCreateMetric(metricName)
+	attributes = rm.limitAttributes(metricName, attributes, startTimestamp, endTimestamp)
 	return metric.GetSum(attributes, isMonotonic, startTimestamp, endTimestamp)
 }
 
+// SetDescription sets the description of a metric.
+func (rm *ResourceMetrics) SetDescription(metricName string, description string) {
+	if rm.discard {
+		return
+	}
+	rm.GetOrCreateScope(pcommon.NewInstrumentationScope()).GetOrCreateMetric(metricName).description = description
+}
+
+// SetGauge sets the last value of a gauge.
+func (rm *ResourceMetrics) SetGauge(metricName string, attributes pcommon.Map, timestamp pcommon.Timestamp, value int64) {
+	if rm.discard {
+		return
+	}
+	scopeMetrics := rm.GetOrCreateScope(pcommon.NewInstrumentationScope())
+	metric := scopeMetrics.GetOrCreateMetric(metricName)
+	metric.gaugeDatapoints[getKeyFromMap(attributes)] = &GaugeDatapoint{value: value, attributes: attributes, timestamp: timestamp}
+}
+
+// SetStaleGauge marks the series of a gauge as ended, with a datapoint flagged as having no recorded value.
+func (rm *ResourceMetrics) SetStaleGauge(metricName string, attributes pcommon.Map, timestamp pcommon.Timestamp) {
+	if rm.discard {
+		return
+	}
+	scopeMetrics := rm.GetOrCreateScope(pcommon.NewInstrumentationScope())
+	metric := scopeMetrics.GetOrCreateMetric(metricName)
+	metric.gaugeDatapoints[getKeyFromMap(attributes)] = &GaugeDatapoint{attributes: attributes, timestamp: timestamp, stale: true}
+}
+
 func (m *Metric) GetSum(attributes pcommon.Map, isMonotonic bool, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) *SumDatapoint {
 	dp, dpPresent := m.sumDatapoints[getKeyFromMap(attributes)]
 	if !dpPresent {
@@ -148,6 +228,7 @@ func (m *Metric) GetSum(attributes pcommon.Map, isMonotonic bool, startTimestamp
 
 func (m *SumDatapoint) Add(value int64, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) {
 	m.value += value
+	m.updated = true
 	if m.startTimestamp.AsTime().After(startTimestamp.AsTime()) {
 		m.startTimestamp = startTimestamp
 	}
@@ -170,6 +251,7 @@ func (sm *ScopeMetrics) GetOrCreateMetric(metricName string) *Metric {
 		metricName:          metricName,
 		histogramDatapoints: make(map[string]*HistogramDatapoint),
 		sumDatapoints:       make(map[string]*SumDatapoint),
+		gaugeDatapoints:     make(map[string]*GaugeDatapoint),
 	}
 	sm.metrics[metricName] = metric
 	return metric
@@ -178,8 +260,10 @@ func (sm *ScopeMetrics) GetOrCreateMetric(metricName string) *Metric {
 type Metric struct {
 	histogramDatapoints map[string]*HistogramDatapoint
 	sumDatapoints       map[string]*SumDatapoint
+	gaugeDatapoints     map[string]*GaugeDatapoint
 	metricName          string
 	unit                string
+	description         string
 }
 
 func (m *Metric) AddHistogramDatapoint(attributes pcommon.Map, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp, value float64) {
@@ -190,6 +274,7 @@ func (m *Metric) AddHistogramDatapoint(attributes pcommon.Map, startTimestamp pc
 		m.histogramDatapoints[getKeyFromMap(attributes)] = dp
 	}
 	dp.histogram.Update(value)
+	dp.updated = true
 	if dp.startTimestamp.AsTime().After(startTimestamp.AsTime()) {
 		dp.startTimestamp = startTimestamp
 	}
@@ -205,6 +290,7 @@ func (m *Metric) IncrementSumDatapoint(attributes pcommon.Map, startTimestamp pc
 		m.sumDatapoints[getKeyFromMap(attributes)] = dp
 	}
 	dp.value++
+	dp.updated = true
 	if dp.startTimestamp.AsTime().After(startTimestamp.AsTime()) {
 		dp.startTimestamp = startTimestamp
 	}
@@ -222,6 +308,11 @@ type HistogramDatapoint struct {
 	attributes     pcommon.Map
 	startTimestamp pcommon.Timestamp
 	timestamp      pcommon.Timestamp
+	// start of the cumulative series, set the first time the datapoint is aggregated
+	seriesStart pcommon.Timestamp
+	// whether a value was recorded since the datapoint was last aggregated, and when it last was
+	updated  bool
+	lastSeen time.Time
 }
 
 type SumDatapoint struct {
@@ -230,6 +321,19 @@ type SumDatapoint struct {
 	startTimestamp pcommon.Timestamp
 	timestamp      pcommon.Timestamp
 	isMonotonic    bool
+	// start of the cumulative series, set the first time the datapoint is aggregated
+	seriesStart pcommon.Timestamp
+	// whether a value was recorded since the datapoint was last aggregated, and when it last was
+	updated  bool
+	lastSeen time.Time
+}
+
+type GaugeDatapoint struct {
+	value      int64
+	attributes pcommon.Map
+	timestamp  pcommon.Timestamp
+	// true for the last datapoint of a series
+	stale bool
 }
 
 func getKeyFromMap(pMap pcommon.Map) string {
@@ -0,0 +1,140 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	CallerServiceAttributeName = "callerService"
+	CalleeServiceAttributeName = "calleeService"
+
+	// how long calls wait for their callee when transactions are not buffered
+	defaultServiceMapGracePeriod = 5 * time.Second
+)
+
+// ServiceMap records the calls between services. A call made by a client or producer span goes to the service
+// of each server or consumer span whose parent it is, even when their resources differ. When no such span is
+// seen, the callee is named after the `peer.service` or the server address of the call.
+type ServiceMap struct {
+	errorClassifier *ErrorClassifier
+
+	lock sync.Mutex
+	// client and producer spans, by trace and span ID
+	calls map[string]*serviceCall
+	// services of the server and consumer spans, by trace and parent span ID, as several consumers may
+	// receive the message of a producer
+	callees map[string][]*serviceCallee
+}
+
+// serviceCall is what an edge needs of a client or producer span, copied as the span is not kept after the
+// batch is consumed.
+type serviceCall struct {
+	startTimestamp, endTimestamp pcommon.Timestamp
+	errorKind                    ErrorKind
+	// callee of the call when no callee span is seen
+	uninstrumentedCalleeService string
+	callerService               string
+	resourceAttributes          pcommon.Map
+	addedAt                     time.Time
+}
+
+type serviceCallee struct {
+	serviceName string
+	addedAt     time.Time
+}
+
+func NewServiceMap(errorClassifier *ErrorClassifier) *ServiceMap {
+	return &ServiceMap{errorClassifier: errorClassifier, calls: make(map[string]*serviceCall), callees: make(map[string][]*serviceCallee)}
+}
+
+// AddSpan keeps the calls made by a service and the calls received by a service until the edges are recorded.
+func (serviceMap *ServiceMap) AddSpan(span ptrace.Span, serviceName string, resourceAttributes pcommon.Map, now time.Time) {
+	serviceMap.lock.Lock()
+	defer serviceMap.lock.Unlock()
+	switch span.Kind() {
+	case ptrace.SpanKindClient, ptrace.SpanKindProducer:
+		serviceMap.calls[getSpanKey(span.TraceID(), span.SpanID())] = &serviceCall{startTimestamp: span.StartTimestamp(),
+			endTimestamp: span.EndTimestamp(), errorKind: serviceMap.errorClassifier.ClassifySpan(span),
+			uninstrumentedCalleeService: getUninstrumentedCalleeService(span.Attributes()), callerService: serviceName,
+			resourceAttributes: resourceAttributes, addedAt: now}
+	case ptrace.SpanKindServer, ptrace.SpanKindConsumer:
+		if !span.ParentSpanID().IsEmpty() {
+			key := getSpanKey(span.TraceID(), span.ParentSpanID())
+			serviceMap.callees[key] = append(serviceMap.callees[key], &serviceCallee{serviceName: serviceName, addedAt: now})
+		}
+	}
+}
+
+// RecordEdges records the calls whose callees are known, and the calls added at least gracePeriod ago, which are
+// recorded with the fallback callee. When force is true, every call is recorded. Calls and callees are then
+// forgotten.
+func (serviceMap *ServiceMap) RecordEdges(metrics Metrics, cardinalityLimits *CardinalityLimits, now time.Time, gracePeriod time.Duration, force bool) {
+	serviceMap.lock.Lock()
+	defer serviceMap.lock.Unlock()
+	for key, call := range serviceMap.calls {
+		var calleeServices []string
+		if callees, exists := serviceMap.callees[key]; exists {
+			calleeServices = getCalleeServices(callees)
+			delete(serviceMap.callees, key)
+		} else if !force && now.Before(call.addedAt.Add(gracePeriod)) {
+			continue
+		} else if call.uninstrumentedCalleeService != "" {
+			calleeServices = []string{call.uninstrumentedCalleeService}
+		}
+		delete(serviceMap.calls, key)
+		for _, calleeService := range calleeServices {
+			serviceMap.recordEdge(metrics.GetOrCreateLimitedResource(call.resourceAttributes, cardinalityLimits), call, calleeService)
+		}
+	}
+	for key, callees := range serviceMap.callees {
+		if force || !now.Before(callees[len(callees)-1].addedAt.Add(gracePeriod)) {
+			delete(serviceMap.callees, key)
+		}
+	}
+}
+
+// getCalleeServices returns the distinct services of the callees of a call, in the order they were added.
+func getCalleeServices(callees []*serviceCallee) []string {
+	calleeServices := make([]string, 0, len(callees))
+	seen := make(map[string]bool, len(callees))
+	for _, callee := range callees {
+		if !seen[callee.serviceName] {
+			seen[callee.serviceName] = true
+			calleeServices = append(calleeServices, callee.serviceName)
+		}
+	}
+	return calleeServices
+}
+
+func (serviceMap *ServiceMap) recordEdge(resourceMetrics *ResourceMetrics, call *serviceCall, calleeService string) {
+	attributes := pcommon.NewMap()
+	attributes.PutStr(CallerServiceAttributeName, call.callerService)
+	attributes.PutStr(CalleeServiceAttributeName, calleeService)
+
+	resourceMetrics.IncrementMonotonicSum("apm.service.map.call.count", attributes, call.startTimestamp, call.endTimestamp)
+	if call.errorKind == Error {
+		resourceMetrics.IncrementMonotonicSum("apm.service.map.call.error.count", attributes, call.startTimestamp, call.endTimestamp)
+	}
+	resourceMetrics.AddHistogram("apm.service.map.call.duration", attributes, call.startTimestamp, call.endTimestamp,
+		int64(call.endTimestamp-call.startTimestamp))
+}
+
+// getUninstrumentedCalleeService names the callee of a call to a service that does not send spans.
+func getUninstrumentedCalleeService(attributes pcommon.Map) string {
+	calleeService, _ := GetFirst(attributes, []string{"peer.service", "server.address", "net.peer.name"})
+	if calleeService.Type() == pcommon.ValueTypeEmpty {
+		return ""
+	}
+	return calleeService.AsString()
+}
+
+func getSpanKey(traceID pcommon.TraceID, spanID pcommon.SpanID) string {
+	return traceID.String() + ":" + spanID.String()
+}
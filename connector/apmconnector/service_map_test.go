@@ -0,0 +1,147 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+func TestConvertTracesServiceMap(t *testing.T) {
+	end := time.Unix(1000, 0)
+	traces := newTestTraces()
+	frontendSpans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	setTestSpan(frontendSpans.AppendEmpty(), "GET /", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	setTestSpan(frontendSpans.AppendEmpty(), "GET /users", 2, 1, ptrace.SpanKindClient, end.Add(-time.Second), end)
+	payments := frontendSpans.AppendEmpty()
+	setTestSpan(payments, "POST /charge", 3, 1, ptrace.SpanKindClient, end.Add(-time.Second), end)
+	payments.Attributes().PutStr("peer.service", "payments")
+	payments.Attributes().PutStr("server.address", "payments.example.com")
+	payments.Status().SetCode(ptrace.StatusCodeError)
+
+	backend := traces.ResourceSpans().AppendEmpty()
+	backend.Resource().Attributes().PutStr("service.name", "users")
+	backend.Resource().Attributes().PutStr("instrumentation.provider", "newrelic-opentelemetry")
+	setTestSpan(backend.ScopeSpans().AppendEmpty().Spans().AppendEmpty(), "GET /users", 4, 2, ptrace.SpanKindServer, end.Add(-time.Second), end)
+
+	metrics := ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5}, traces)
+
+	assert.Equal(t, map[string]int64{"service->users": 1, "service->payments": 1}, getServiceMapEdges(metrics, "apm.service.map.call.count"))
+	assert.Equal(t, map[string]int64{"service->payments": 1}, getServiceMapEdges(metrics, "apm.service.map.call.error.count"))
+	duration := findMetric(t, "apm.service.map.call.duration", getAllMetrics(metrics))
+	assert.Equal(t, 2, duration.ExponentialHistogram().DataPoints().Len())
+}
+
+func TestServiceMapWaitsForCallees(t *testing.T) {
+	now := time.Unix(1000, 0)
+	serviceMap := NewServiceMap(NewErrorClassifier(ErrorsConfig{}))
+	resourceAttributes := pcommon.NewMap()
+	resourceAttributes.PutStr("service.name", "frontend")
+
+	client := ptrace.NewSpan()
+	setTestSpan(client, "GET /users", 2, 1, ptrace.SpanKindClient, now.Add(-time.Second), now)
+	client.Attributes().PutStr("server.address", "users.example.com")
+	serviceMap.AddSpan(client, "frontend", resourceAttributes, now)
+
+	metricMap := NewMetrics()
+	serviceMap.RecordEdges(metricMap, nil, now, time.Second, false)
+	assert.Empty(t, getServiceMapEdges(metricMap.AppendOtelMetrics(pmetric.NewMetrics()), "apm.service.map.call.count"))
+
+	server := ptrace.NewSpan()
+	setTestSpan(server, "GET /users", 3, 2, ptrace.SpanKindServer, now.Add(-time.Second), now)
+	serviceMap.AddSpan(server, "users", pcommon.NewMap(), now)
+	serviceMap.RecordEdges(metricMap, nil, now, time.Second, false)
+	assert.Equal(t, map[string]int64{"frontend->users": 1}, getServiceMapEdges(metricMap.AppendOtelMetrics(pmetric.NewMetrics()), "apm.service.map.call.count"))
+
+	// without callee, the server address is used once the grace period is over
+	client.SetSpanID(pcommon.SpanID{5})
+	serviceMap.AddSpan(client, "frontend", resourceAttributes, now)
+	metricMap = NewMetrics()
+	serviceMap.RecordEdges(metricMap, nil, now.Add(time.Second), time.Second, false)
+	assert.Equal(t, map[string]int64{"frontend->users.example.com": 1}, getServiceMapEdges(metricMap.AppendOtelMetrics(pmetric.NewMetrics()), "apm.service.map.call.count"))
+	assert.Empty(t, serviceMap.calls)
+	assert.Empty(t, serviceMap.callees)
+}
+
+func getServiceMapEdges(metrics pmetric.Metrics, metricName string) map[string]int64 {
+	edges := make(map[string]int64)
+	allMetrics := getAllMetrics(metrics)
+	for i := 0; i < allMetrics.Len(); i++ {
+		if allMetrics.At(i).Name() != metricName {
+			continue
+		}
+		dps := allMetrics.At(i).Sum().DataPoints()
+		for j := 0; j < dps.Len(); j++ {
+			caller, _ := dps.At(j).Attributes().Get(CallerServiceAttributeName)
+			callee, _ := dps.At(j).Attributes().Get(CalleeServiceAttributeName)
+			edges[caller.Str()+"->"+callee.Str()] += dps.At(j).IntValue()
+		}
+	}
+	return edges
+}
+
+func TestServiceMapAcrossBatchesWithoutBuffering(t *testing.T) {
+	end := time.Unix(1000, 0)
+	config := &Config{ApdexT: 0.5}
+	state := newConnectorState(config)
+
+	// the client span and the server span it calls are sent in different batches
+	frontend := newTestTraces()
+	frontendSpans := frontend.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	setTestSpan(frontendSpans.AppendEmpty(), "GET /", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	client := frontendSpans.AppendEmpty()
+	setTestSpan(client, "GET /users", 2, 1, ptrace.SpanKindClient, end.Add(-time.Second), end)
+	client.Attributes().PutStr("server.address", "users.example.com")
+	assert.Empty(t, getServiceMapEdges(convertTraces(zap.NewNop(), config, state, frontend, end), "apm.service.map.call.count"))
+
+	users := newTestTraces()
+	users.ResourceSpans().At(0).Resource().Attributes().PutStr("service.name", "users")
+	setTestSpan(users.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty(), "GET /users", 3, 2, ptrace.SpanKindServer,
+		end.Add(-time.Second), end)
+	metrics := convertTraces(zap.NewNop(), config, state, users, end.Add(time.Second))
+	assert.Equal(t, map[string]int64{"service->users": 1}, getServiceMapEdges(metrics, "apm.service.map.call.count"))
+	assert.Empty(t, state.serviceMap.calls)
+}
+
+func TestServiceMapRecordsEveryConsumer(t *testing.T) {
+	now := time.Unix(1000, 0)
+	serviceMap := NewServiceMap(NewErrorClassifier(ErrorsConfig{}))
+	producer := ptrace.NewSpan()
+	setTestSpan(producer, "orders publish", 2, 1, ptrace.SpanKindProducer, now.Add(-time.Second), now)
+	serviceMap.AddSpan(producer, "orders", pcommon.NewMap(), now)
+	for i, serviceName := range []string{"billing", "shipping", "billing"} {
+		consumer := ptrace.NewSpan()
+		setTestSpan(consumer, "orders process", byte(3+i), 2, ptrace.SpanKindConsumer, now.Add(-time.Second), now)
+		serviceMap.AddSpan(consumer, serviceName, pcommon.NewMap(), now)
+	}
+
+	metricMap := NewMetrics()
+	serviceMap.RecordEdges(metricMap, nil, now, time.Second, false)
+	assert.Equal(t, map[string]int64{"orders->billing": 1, "orders->shipping": 1},
+		getServiceMapEdges(metricMap.AppendOtelMetrics(pmetric.NewMetrics()), "apm.service.map.call.count"))
+}
+
+func TestServiceMapDoesNotKeepSpans(t *testing.T) {
+	now := time.Unix(1000, 0)
+	serviceMap := NewServiceMap(NewErrorClassifier(ErrorsConfig{}))
+	client := ptrace.NewSpan()
+	setTestSpan(client, "GET /users", 2, 1, ptrace.SpanKindClient, now.Add(-time.Second), now)
+	client.Attributes().PutStr("peer.service", "users")
+	serviceMap.AddSpan(client, "frontend", pcommon.NewMap(), now)
+	// the span belongs to the batch, which may be changed once it is consumed
+	client.Attributes().PutStr("peer.service", "changed")
+	client.Status().SetCode(ptrace.StatusCodeError)
+
+	metricMap := NewMetrics()
+	serviceMap.RecordEdges(metricMap, nil, now, 0, true)
+	metrics := metricMap.AppendOtelMetrics(pmetric.NewMetrics())
+	assert.Equal(t, map[string]int64{"frontend->users": 1}, getServiceMapEdges(metrics, "apm.service.map.call.count"))
+	assert.Empty(t, getServiceMapEdges(metrics, "apm.service.map.call.error.count"))
+}
@@ -0,0 +1,154 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+)
+
+const (
+	transactionTraceEvent = "apm.transaction.trace"
+
+	defaultMaxSlowTransactionsPerName = 1
+	defaultSlowTransactionsInterval   = time.Minute
+)
+
+// SlowTransactionTraces keeps the slowest transactions of each transaction name until they are flushed,
+// as log records describing their segments.
+type SlowTransactionTraces struct {
+	maxPerName     int
+	thresholdNanos int64
+	// slowest transactions first, by resource and transaction name
+	traces map[string][]slowTransactionTrace
+}
+
+type slowTransactionTrace struct {
+	resourceAttributes pcommon.Map
+	durationNanos      int64
+	record             plog.LogRecord
+}
+
+func NewSlowTransactionTraces(config SlowTransactionsConfig) *SlowTransactionTraces {
+	maxPerName := config.MaxPerTransactionName
+	if maxPerName == 0 {
+		maxPerName = defaultMaxSlowTransactionsPerName
+	}
+	return &SlowTransactionTraces{maxPerName: maxPerName, thresholdNanos: config.Threshold.Nanoseconds(),
+		traces: make(map[string][]slowTransactionTrace)}
+}
+
+// Offer keeps the transaction when it is one of the slowest of its name. The trace is only built when kept.
+func (slowTraces *SlowTransactionTraces) Offer(transaction *Transaction, transactionName string, transactionType TransactionType) {
+	durationNanos := DurationInNanos(transaction.RootSpan)
+	if durationNanos < slowTraces.thresholdNanos {
+		return
+	}
+	resourceAttributes := transaction.resourceMetrics.attributes
+	key := getKeyFromMap(resourceAttributes) + transactionName
+	traces := slowTraces.traces[key]
+	if len(traces) >= slowTraces.maxPerName && traces[len(traces)-1].durationNanos >= durationNanos {
+		return
+	}
+
+	trace := slowTransactionTrace{resourceAttributes: resourceAttributes, durationNanos: durationNanos,
+		record: newTransactionTraceRecord(transaction, transactionName, transactionType)}
+	i := sort.Search(len(traces), func(i int) bool { return traces[i].durationNanos < durationNanos })
+	traces = append(traces, slowTransactionTrace{})
+	copy(traces[i+1:], traces[i:])
+	traces[i] = trace
+	if len(traces) > slowTraces.maxPerName {
+		traces = traces[:slowTraces.maxPerName]
+	}
+	slowTraces.traces[key] = traces
+}
+
+// Flush adds the kept transactions to the logs and forgets them.
+func (slowTraces *SlowTransactionTraces) Flush(logs *Logs) {
+	for _, traces := range slowTraces.traces {
+		for _, trace := range traces {
+			trace.record.CopyTo(logs.AppendLogRecord(trace.resourceAttributes))
+		}
+	}
+	slowTraces.traces = make(map[string][]slowTransactionTrace)
+}
+
+// newTransactionTraceRecord creates a log record whose body is the tree of the segments of a transaction. Each segment
+// has its metric timeslice name, its start relative to the start of the transaction and its total and exclusive durations,
+// in seconds.
+func newTransactionTraceRecord(transaction *Transaction, transactionName string, transactionType TransactionType) plog.LogRecord {
+	span := transaction.RootSpan
+	record := plog.NewLogRecord()
+	record.SetTimestamp(span.EndTimestamp())
+	record.SetObservedTimestamp(span.EndTimestamp())
+	record.SetSeverityNumber(plog.SeverityNumberInfo)
+	record.SetSeverityText("INFO")
+	record.SetTraceID(span.TraceID())
+	record.SetSpanID(span.SpanID())
+
+	attributes := record.Attributes()
+	attributes.PutStr(EventNameAttributeName, transactionTraceEvent)
+	attributes.PutStr("transactionName", transactionName)
+	attributes.PutStr("transactionType", transactionType.AsString())
+	attributes.PutDouble("duration", NanosToSeconds(DurationInNanos(span)))
+	attributes.PutStr("trace.id", span.TraceID().String())
+
+	// segments by parent, segments whose parent is not part of the transaction are attached to the root, segments
+	// whose parents form a cycle have no root ancestor and are left out
+	rootSpanID := span.SpanID().String()
+	children := make(map[string][]*Measurement)
+	for spanID, measurement := range transaction.Measurements {
+		if spanID == rootSpanID {
+			continue
+		}
+		parentSpanID := transaction.spanParents[spanID]
+		if _, exists := transaction.Measurements[parentSpanID]; !exists || parentSpanID == rootSpanID || parentSpanID == spanID {
+			parentSpanID = rootSpanID
+		}
+		children[parentSpanID] = append(children[parentSpanID], measurement)
+	}
+
+	root := record.Body().SetEmptyMap()
+	rootExclusiveNanos := transaction.RootExclusiveTime()
+	if measurement, exists := transaction.Measurements[rootSpanID]; exists {
+		rootExclusiveNanos = measurement.ExclusiveDurationNanos
+	}
+	putSegment(root, span.Name(), rootSpanID, transactionName, 0, DurationInNanos(span), rootExclusiveNanos)
+	addChildSegments(root, rootSpanID, children, span.StartTimestamp())
+	return record
+}
+
+func addChildSegments(segment pcommon.Map, spanID string, children map[string][]*Measurement, transactionStart pcommon.Timestamp) {
+	measurements := children[spanID]
+	if len(measurements) == 0 {
+		return
+	}
+	sort.Slice(measurements, func(i, j int) bool {
+		return measurements[i].Span.StartTimestamp() < measurements[j].Span.StartTimestamp()
+	})
+	childSegments := segment.PutEmptySlice("children")
+	for _, measurement := range measurements {
+		child := childSegments.AppendEmpty().SetEmptyMap()
+		startOffsetNanos := int64(measurement.Span.StartTimestamp()) - int64(transactionStart)
+		putSegment(child, measurement.Span.Name(), measurement.SpanID, measurement.MetricTimesliceName, startOffsetNanos,
+			measurement.DurationNanos, measurement.ExclusiveDurationNanos)
+		addChildSegments(child, measurement.SpanID, children, transactionStart)
+	}
+}
+
+func putSegment(segment pcommon.Map, name string, spanID string, metricTimesliceName string, startOffsetNanos int64,
+	durationNanos int64, exclusiveDurationNanos int64) {
+	if exclusiveDurationNanos < 0 {
+		exclusiveDurationNanos = 0
+	}
+	segment.PutStr("name", name)
+	segment.PutStr("spanId", spanID)
+	segment.PutStr("metricTimesliceName", metricTimesliceName)
+	segment.PutDouble("startOffset", NanosToSeconds(startOffsetNanos))
+	segment.PutDouble("duration", NanosToSeconds(durationNanos))
+	segment.PutDouble("exclusiveDuration", NanosToSeconds(exclusiveDurationNanos))
+}
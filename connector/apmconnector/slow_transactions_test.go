@@ -0,0 +1,46 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+func TestSlowTransactionTracesKeepsTheSlowestPerName(t *testing.T) {
+	slowTraces := NewSlowTransactionTraces(SlowTransactionsConfig{MaxPerTransactionName: 2, Threshold: time.Second})
+	metrics := NewMetrics()
+	resourceMetrics := metrics.GetOrCreateResource(pcommon.NewMap())
+	end := time.Unix(1000, 0)
+	offer := func(name string, traceID byte, duration time.Duration) {
+		transaction := &Transaction{resourceMetrics: resourceMetrics, Measurements: make(map[string]*Measurement)}
+		root := ptrace.NewSpan()
+		setTestSpan(root, name, 1, 0, ptrace.SpanKindServer, end.Add(-duration), end)
+		root.SetTraceID(pcommon.TraceID{traceID})
+		transaction.RootSpan = root
+		slowTraces.Offer(transaction, name, WebTransactionType)
+	}
+	offer("a", 1, 2*time.Second)
+	offer("a", 2, 500*time.Millisecond)
+	offer("a", 3, 4*time.Second)
+	offer("a", 4, 3*time.Second)
+	offer("b", 5, time.Second)
+
+	logs := NewLogs()
+	slowTraces.Flush(logs)
+	records := logs.OtelLogs().ResourceLogs().At(0).ScopeLogs().At(0).LogRecords()
+	traceIDs := []pcommon.TraceID{}
+	for i := 0; i < records.Len(); i++ {
+		traceIDs = append(traceIDs, records.At(i).TraceID())
+	}
+	assert.ElementsMatch(t, []pcommon.TraceID{{3}, {4}, {5}}, traceIDs)
+
+	logs = NewLogs()
+	slowTraces.Flush(logs)
+	assert.Equal(t, 0, logs.LogRecordCount())
+}
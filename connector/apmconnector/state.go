@@ -0,0 +1,41 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import "time"
+
+// connectorState is the state a connector keeps for as long as it runs, across batches and aggregation
+// intervals, whether or not transactions are buffered.
+type connectorState struct {
+	instances         *InstanceInventory
+	cardinalityLimits *CardinalityLimits
+	// calls between services, waiting for their callee for serviceMapGracePeriod even when
+	// transactions are not buffered, as the callee spans may come in a later batch
+	serviceMap            *ServiceMap
+	serviceMapGracePeriod time.Duration
+}
+
+func newConnectorState(config *Config) *connectorState {
+	serviceMapGracePeriod := defaultServiceMapGracePeriod
+	if config.isTransactionBufferingEnabled() {
+		serviceMapGracePeriod = config.TransactionGracePeriod
+	}
+	return &connectorState{instances: NewInstanceInventory(config), cardinalityLimits: NewCardinalityLimits(config.CardinalityLimits),
+		serviceMap: NewServiceMap(NewErrorClassifier(config.Errors)), serviceMapGracePeriod: serviceMapGracePeriod}
+}
+
+// newTransactionsMap returns transactions recording their metrics with the state of the connector.
+func (state *connectorState) newTransactionsMap(config *Config) *TransactionsMap {
+	transactions := NewTransactionsMap(config)
+	transactions.instances = state.instances
+	transactions.cardinalityLimits = state.cardinalityLimits
+	transactions.serviceMap = state.serviceMap
+	return transactions
+}
+
+// recordServiceMapEdges records the calls between services whose callee is known or was awaited for the
+// grace period, or all of them when force is true.
+func (state *connectorState) recordServiceMapEdges(metrics Metrics, now time.Time, force bool) {
+	state.serviceMap.RecordEdges(metrics, state.cardinalityLimits, now, state.serviceMapGracePeriod, force)
+}
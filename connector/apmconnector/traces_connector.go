@@ -0,0 +1,108 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// how often buffered transactions are checked for completion
+const transactionFlushInterval = time.Second
+
+// tracesConnector is the flow shared by the connectors of the traces pipeline: spans are added to the
+// transactions they belong to, buffered across batches when transaction buffering is enabled, and the
+// transactions are processed once complete, as batches come in and periodically.
+type tracesConnector struct {
+	config          *Config
+	logger          *zap.Logger
+	attributeFilter *AttributeFilter
+	newTransactions func() *TransactionsMap
+
+	// state kept across batches
+	lock         sync.Mutex
+	transactions *TransactionsMap
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+func newTracesConnector(config *Config, logger *zap.Logger, newTransactions func() *TransactionsMap) tracesConnector {
+	return tracesConnector{
+		config:          config,
+		logger:          logger,
+		attributeFilter: NewAttributeFilter(config.ResourceAttributes.Include, config.ResourceAttributes.Exclude),
+		newTransactions: newTransactions,
+		done:            make(chan struct{}),
+	}
+}
+
+// start buffers transactions across batches when transaction buffering is enabled, and processes the buffered
+// transactions that are complete every transactionFlushInterval with flush.
+func (c *tracesConnector) start(flush func(ctx context.Context) error) {
+	if c.config.ApdexT == 0 {
+		c.config.ApdexT = defaultApdexT
+	}
+	if c.config.isTransactionBufferingEnabled() {
+		c.transactions = c.newTransactions()
+		c.flushEvery(transactionFlushInterval, flush)
+	}
+}
+
+// stop stops the periodic flushes, the caller then flushes what is left.
+func (c *tracesConnector) stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// flushEvery calls flush at every interval until the connector is stopped.
+func (c *tracesConnector) flushEvery(interval time.Duration, flush func(ctx context.Context) error) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if err := flush(context.Background()); err != nil {
+					c.logger.Error("Could not send APM data", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// addTraces adds the spans of a batch to the buffered transactions, or to new ones when transactions are not
+// buffered, and processes the complete transactions, recording into metrics and logs. Nothing is recorded in
+// nil metrics or logs. The lock must be held.
+func (c *tracesConnector) addTraces(td ptrace.Traces, metrics Metrics, logs *Logs, now time.Time) {
+	if c.config.needsTracesCopy() {
+		// spans are modified or kept after this call returns, we can't change or hold on to data we don't own
+		traces := ptrace.NewTraces()
+		td.CopyTo(traces)
+		td = traces
+	}
+	transactions := c.transactions
+	if transactions == nil {
+		transactions = c.newTransactions()
+	}
+	transactions.AddTraces(c.logger, c.attributeFilter, metrics, td, now)
+	transactions.ProcessCompletedTransactions(metrics, logs, now, c.config.TransactionGracePeriod, c.config.TransactionMaxWait,
+		c.transactions == nil)
+}
+
+// processCompletedTransactions processes the buffered transactions that are complete, or all of them when forced.
+// The lock must be held.
+func (c *tracesConnector) processCompletedTransactions(metrics Metrics, logs *Logs, now time.Time, force bool) {
+	if c.transactions != nil {
+		c.transactions.ProcessCompletedTransactions(metrics, logs, now, c.config.TransactionGracePeriod,
+			c.config.TransactionMaxWait, force)
+	}
+}
@@ -5,7 +5,9 @@ package apmconnector // import "github.com/newrelic/opentelemetry-collector-comp
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
@@ -17,8 +19,27 @@ const (
 	DbOperationAttributeName = "db.operation"
 	DbSystemAttributeName    = "db.system"
 	DbSQLTableAttributeName  = "db.sql.table"
+
+	MessagingSystemAttributeName          = "messaging.system"
+	MessagingDestinationNameAttributeName = "messaging.destination.name"
+
+	defaultBackgroundTransactionName = "OtherTransaction/Custom/{scope}/{span}"
+
+	defaultOrphanTransactionName = "WebTransaction/Other/Unknown"
+	orphanTransactionMetricName  = "apm.service.orphan.transaction.count"
+	orphanSpanMetricName         = "apm.service.orphan.span.count"
+
+	defaultMaxBufferedTransactions = 10000
+	evictedTransactionsMetricName  = "apm.service.transaction.evicted.count"
 )
 
+// metrics of the measurements of orphan spans recorded under the fallback transaction name
+var orphanMeasurementMetrics = map[string]bool{
+	"apm.service.datastore.operation.duration":       true,
+	"apm.service.transaction.external.host.duration": true,
+	"apm.service.messaging.operation.duration":       true,
+}
+
 const (
 	WebTransactionType   TransactionType = "Web"
 	OtherTransactionType TransactionType = "Other"
@@ -57,13 +78,55 @@ func (apdex Apdex) GetApdexZone(durationInSeconds float64) string {
 	}
 }
 
+// transactionSettings are the settings of a transaction, shared by the transactions it is split into.
+type transactionSettings struct {
+	SdkLanguage     string
+	apdexRules      ApdexRules
+	serviceName     string
+	errorClassifier *ErrorClassifier
+	errorClasses    errorClassesSettings
+	urlNormalizer   *URLNormalizer
+	// where the error classes of the service are known across batches
+	cardinalityLimits *CardinalityLimits
+	// true for SDKs that do not emit duration metrics
+	deriveMetricsFromSpans bool
+	// name of the transactions of root internal spans
+	backgroundTransactionName string
+}
+
 type Transaction struct {
-	SdkLanguage         string
-	SpanToChildDuration map[string]int64
-	resourceMetrics     *ResourceMetrics
-	Measurements        map[string]*Measurement
-	apdex               Apdex
-	RootSpan            ptrace.Span
+	transactionSettings
+	// time ranges of the children of each span, by parent span ID
+	SpanToChildIntervals map[string][]TimeInterval
+	resourceMetrics      *ResourceMetrics
+	Measurements         map[string]*Measurement
+	// exceptions recorded on the spans of the transaction and the parent of each span,
+	// used to find the class of the error of failed transactions
+	exceptions  []ExceptionEvent
+	spanParents map[string]string
+	// all the spans, in the order they were added, and whether their measurements were built
+	spans    []ptrace.Span
+	measured bool
+	// where log records are produced, nil when the transaction is only converted to metrics
+	logs *Logs
+	// instrumentation scope of the root span
+	rootScopeName string
+	RootSpan      ptrace.Span
+	// the span the transaction is named after, when it is not the root span
+	nameSpan ptrace.Span
+	// when the transaction was first seen and when its current root span was set,
+	// only used when transactions are buffered across batches
+	createdAt, rootSetAt time.Time
+}
+
+// newTransaction returns an empty transaction with the given settings.
+func newTransaction(settings transactionSettings, resourceMetrics *ResourceMetrics) *Transaction {
+	return &Transaction{transactionSettings: settings, SpanToChildIntervals: make(map[string][]TimeInterval),
+		resourceMetrics: resourceMetrics, Measurements: make(map[string]*Measurement), spanParents: make(map[string]string)}
+}
+
+type TimeInterval struct {
+	Start, End pcommon.Timestamp
 }
 
 type Measurement struct {
@@ -76,19 +139,124 @@ type Measurement struct {
 }
 
 type TransactionsMap struct {
-	apdex        Apdex
-	Transactions map[string]*Transaction
+	apdexRules         ApdexRules
+	spanDerivedMetrics SpanDerivedMetricsConfig
+	errorClassifier    *ErrorClassifier
+	errorClasses       errorClassesSettings
+	urlNormalizer      *URLNormalizer
+	cardinalityLimits  *CardinalityLimits
+	correctClockSkew   bool
+	serviceMap         *ServiceMap
+	// name of the transactions of root internal spans
+	backgroundTransactionName string
+	// transaction name of the measurements of orphan spans, empty when they are dropped
+	orphanTransactionName string
+	Transactions          map[string]*Transaction
+	// beyond it, the transactions buffered the longest are processed before they are ready
+	maxBufferedTransactions int
+	// nil when instances are not reported
+	instances *InstanceInventory
 }
 
-func NewTransactionsMap(apdexT float64) *TransactionsMap {
-	return &TransactionsMap{Transactions: make(map[string]*Transaction), apdex: NewApdex(apdexT)}
+type errorClassesSettings struct {
+	attribution string
+	maxClasses  int
+}
+
+func NewTransactionsMap(config *Config) *TransactionsMap {
+	errorClassifier := NewErrorClassifier(config.Errors)
+	maxBufferedTransactions := config.MaxBufferedTransactions
+	if maxBufferedTransactions == 0 {
+		maxBufferedTransactions = defaultMaxBufferedTransactions
+	}
+	return &TransactionsMap{Transactions: make(map[string]*Transaction), apdexRules: NewApdexRules(config.ApdexT, config.ApdexTOverrides),
+		spanDerivedMetrics: config.SpanDerivedMetrics, errorClassifier: errorClassifier,
+		errorClasses: newErrorClassesSettings(config.Errors), urlNormalizer: NewURLNormalizer(config.URLNormalization),
+		cardinalityLimits: NewCardinalityLimits(config.CardinalityLimits), correctClockSkew: config.ClockSkew.Correct,
+		backgroundTransactionName: config.BackgroundTransactions.Name,
+		orphanTransactionName:     config.OrphanSpans.getTransactionName(), maxBufferedTransactions: maxBufferedTransactions}
+}
+
+func newErrorClassesSettings(config ErrorsConfig) errorClassesSettings {
+	settings := errorClassesSettings{attribution: config.ClassAttribution, maxClasses: config.MaxClasses}
+	if settings.maxClasses == 0 {
+		settings.maxClasses = defaultMaxErrorClasses
+	}
+	return settings
 }
 
 func (transactions *TransactionsMap) ProcessTransactions() {
 	for _, transaction := range transactions.Transactions {
+		transactions.processTransaction(transaction)
+	}
+}
+
+// processTransaction processes the transaction of each entry span of the transaction. The transactions whose
+// root span was never seen, or is a client or producer span, are processed as orphans.
+func (transactions *TransactionsMap) processTransaction(transaction *Transaction) {
+	for _, entryTransaction := range transaction.SplitByEntrySpan() {
 		// if this returns false, we MAY not have seen all of the spans for a trace
-		transaction.ProcessRootSpan()
+		if !entryTransaction.ProcessRootSpan() {
+			entryTransaction.ProcessOrphanSpans(transactions.orphanTransactionName)
+		}
+	}
+}
+
+// ProcessCompletedTransactions processes and removes the transactions that are ready: their root span was
+// set at least gracePeriod ago, or they have been buffered for maxWait. When force is true, every
+// transaction is processed. When more transactions than the maximum remain, the ones buffered the longest
+// are processed early and counted as evicted. Metrics are recorded in the given Metrics and log records, if any,
+// in the given Logs. It returns the number of processed transactions.
+func (transactions *TransactionsMap) ProcessCompletedTransactions(metrics Metrics, logs *Logs, now time.Time, gracePeriod time.Duration, maxWait time.Duration, force bool) int {
+	processed := 0
+	for key, transaction := range transactions.Transactions {
+		if !force && !transaction.IsReady(now, gracePeriod, maxWait) {
+			continue
+		}
+		transactions.processBufferedTransaction(key, transaction, metrics, logs)
+		processed++
+	}
+
+	excess := len(transactions.Transactions) - transactions.maxBufferedTransactions
+	if excess <= 0 {
+		return processed
+	}
+	keys := make([]string, 0, len(transactions.Transactions))
+	for key := range transactions.Transactions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		createdAt, otherCreatedAt := transactions.Transactions[keys[i]].createdAt, transactions.Transactions[keys[j]].createdAt
+		if createdAt.Equal(otherCreatedAt) {
+			return keys[i] < keys[j]
+		}
+		return createdAt.Before(otherCreatedAt)
+	})
+	timestamp := pcommon.NewTimestampFromTime(now)
+	for _, key := range keys[:excess] {
+		transaction := transactions.Transactions[key]
+		transactions.processBufferedTransaction(key, transaction, metrics, logs)
+		transaction.resourceMetrics.GetSum(evictedTransactionsMetricName, pcommon.NewMap(), true, timestamp, timestamp).Add(1, timestamp, timestamp)
+		processed++
+	}
+	return processed
+}
+
+// processBufferedTransaction processes and removes a buffered transaction.
+func (transactions *TransactionsMap) processBufferedTransaction(key string, transaction *Transaction, metrics Metrics, logs *Logs) {
+	// the transaction may have been created while processing a previous batch, record its metrics
+	// with the current ones
+	transaction.resourceMetrics = metrics.GetOrCreateLimitedResource(transaction.resourceMetrics.attributes, transactions.cardinalityLimits)
+	transaction.logs = logs
+	transactions.processTransaction(transaction)
+	delete(transactions.Transactions, key)
+}
+
+func (transaction *Transaction) IsReady(now time.Time, gracePeriod time.Duration, maxWait time.Duration) bool {
+	if transaction.IsRootSet() && !now.Before(transaction.rootSetAt.Add(gracePeriod)) {
+		return true
 	}
+	return maxWait > 0 && !now.Before(transaction.createdAt.Add(maxWait))
 }
 
 func GetTransactionKey(traceID string, resourceAttributes pcommon.Map) string {
@@ -110,8 +278,12 @@ func (transactions *TransactionsMap) GetOrCreateTransaction(sdkLanguage string,
 	key := GetTransactionKey(traceID, resourceAttributes)
 	transaction, txExists := transactions.Transactions[key]
 	if !txExists {
-		transaction = &Transaction{SdkLanguage: sdkLanguage, SpanToChildDuration: make(map[string]int64),
-			resourceMetrics: resourceMetrics, Measurements: make(map[string]*Measurement), apdex: transactions.apdex}
+		transaction = newTransaction(transactionSettings{SdkLanguage: sdkLanguage, apdexRules: transactions.apdexRules,
+			serviceName: GetServiceName(resourceAttributes), errorClassifier: transactions.errorClassifier,
+			errorClasses: transactions.errorClasses, urlNormalizer: transactions.urlNormalizer,
+			cardinalityLimits:         transactions.cardinalityLimits,
+			deriveMetricsFromSpans:    transactions.spanDerivedMetrics.isEnabledFor(sdkLanguage),
+			backgroundTransactionName: transactions.backgroundTransactionName}, resourceMetrics)
 		transactions.Transactions[key] = transaction
 		//fmt.Printf("Created transaction for: %s   %s\n", traceID, transaction.sdkLanguage)
 	}
@@ -119,14 +291,188 @@ func (transactions *TransactionsMap) GetOrCreateTransaction(sdkLanguage string,
 	return transaction, traceID
 }
 
+// SplitByEntrySpan returns one transaction per server or consumer span of the transaction, such as when a service
+// calls itself or consumes several messages in a trace, and one for the internal root span of a background job.
+// Each span belongs to the transaction of its nearest entry ancestor, spans without such ancestor belong to the
+// transaction of the earliest entry span.
+// Server spans nested in another server span without any call in between, as with stacked instrumentation,
+// are part of the transaction of the outermost one.
+func (transaction *Transaction) SplitByEntrySpan() []*Transaction {
+	spansByID := make(map[string]ptrace.Span, len(transaction.spans))
+	for _, span := range transaction.spans {
+		spansByID[span.SpanID().String()] = span
+	}
+	var entrySpans []ptrace.Span
+	nestedSpans := make(map[string]bool)
+	for _, span := range transaction.spans {
+		if !startsTransaction(span) {
+			continue
+		}
+		if isNestedServerSpan(span, spansByID) {
+			nestedSpans[span.SpanID().String()] = true
+			continue
+		}
+		entrySpans = append(entrySpans, span)
+	}
+	if len(entrySpans) <= 1 {
+		transaction.buildMeasurements()
+		transaction.mergeNestedServerSpans(nestedSpans, spansByID)
+		return []*Transaction{transaction}
+	}
+
+	earliestEntrySpanID := entrySpans[0].SpanID().String()
+	entryTransactions := make(map[string]*Transaction, len(entrySpans))
+	result := make([]*Transaction, 0, len(entrySpans))
+	for _, entrySpan := range entrySpans {
+		if entrySpan.StartTimestamp() < spansByID[earliestEntrySpanID].StartTimestamp() {
+			earliestEntrySpanID = entrySpan.SpanID().String()
+		}
+		entryTransaction := transaction.newEntryTransaction()
+		entryTransactions[entrySpan.SpanID().String()] = entryTransaction
+		result = append(result, entryTransaction)
+	}
+	for _, span := range transaction.spans {
+		entrySpanID, found := getEntrySpanID(span, spansByID, nestedSpans)
+		if !found {
+			entrySpanID = earliestEntrySpanID
+		}
+		entryTransactions[entrySpanID].AddSpan(span)
+	}
+	for _, entryTransaction := range result {
+		entryTransaction.buildMeasurements()
+		entryTransaction.mergeNestedServerSpans(nestedSpans, spansByID)
+	}
+	return result
+}
+
+// newEntryTransaction returns an empty transaction with the same settings.
+func (transaction *Transaction) newEntryTransaction() *Transaction {
+	entryTransaction := newTransaction(transaction.transactionSettings, transaction.resourceMetrics)
+	entryTransaction.logs = transaction.logs
+	// names the transaction of the root span of a background job, the entry spans below it are named after
+	// their attributes
+	entryTransaction.rootScopeName = transaction.rootScopeName
+	return entryTransaction
+}
+
+// mergeNestedServerSpans makes the nested server spans of the transaction part of its root span. The transaction
+// is timed by the outermost server span and named after the innermost span with an http.route, as the most
+// specific one. The children of a nested span count as children of its nearest ancestor that is not nested, so
+// that the time of the nested span is not counted twice in the breakdown.
+func (transaction *Transaction) mergeNestedServerSpans(nestedSpans map[string]bool, spansByID map[string]ptrace.Span) {
+	nameSpanDepth := 0
+	for _, span := range transaction.spans {
+		spanID := span.SpanID().String()
+		if !nestedSpans[spanID] {
+			continue
+		}
+		ancestorSpanID, depth := "", 0
+		forEachAncestor(spanID, getKnownParentID(spansByID), func(parentID string) bool {
+			ancestorSpanID = parentID
+			depth++
+			return nestedSpans[parentID]
+		})
+		transaction.SpanToChildIntervals[ancestorSpanID] = append(transaction.SpanToChildIntervals[ancestorSpanID],
+			transaction.SpanToChildIntervals[spanID]...)
+		delete(transaction.SpanToChildIntervals, spanID)
+
+		if entrySpanID, found := getEntrySpanID(span, spansByID, nestedSpans); found {
+			transaction.RootSpan = spansByID[entrySpanID]
+		}
+		if _, exists := span.Attributes().Get("http.route"); exists && depth > nameSpanDepth {
+			transaction.nameSpan = span
+			nameSpanDepth = depth
+		}
+	}
+}
+
+func isEntrySpan(span ptrace.Span) bool {
+	return span.Kind() == ptrace.SpanKindServer || span.Kind() == ptrace.SpanKindConsumer
+}
+
+// isBackgroundRootSpan returns true for the internal root span of a background job, such as a scheduled task.
+func isBackgroundRootSpan(span ptrace.Span) bool {
+	return span.Kind() == ptrace.SpanKindInternal && span.ParentSpanID().IsEmpty()
+}
+
+// startsTransaction returns true for the spans with a transaction of their own: entry spans, and the root span
+// of a background job, which is not part of the transaction of the messages it consumes or the requests it serves.
+func startsTransaction(span ptrace.Span) bool {
+	return isEntrySpan(span) || isBackgroundRootSpan(span)
+}
+
+// isNestedServerSpan returns true for a server span below another server span, with no client, producer or
+// consumer span in between.
+func isNestedServerSpan(span ptrace.Span, spansByID map[string]ptrace.Span) bool {
+	if span.Kind() != ptrace.SpanKindServer {
+		return false
+	}
+	nested := false
+	forEachAncestor(span.SpanID().String(), getKnownParentID(spansByID), func(parentID string) bool {
+		switch spansByID[parentID].Kind() {
+		case ptrace.SpanKindServer:
+			nested = true
+			return false
+		case ptrace.SpanKindClient, ptrace.SpanKindProducer, ptrace.SpanKindConsumer:
+			return false
+		}
+		return true
+	})
+	return nested
+}
+
+// getEntrySpanID returns the ID of the nearest span starting a transaction among the span and its ancestors,
+// nested server spans excluded.
+func getEntrySpanID(span ptrace.Span, spansByID map[string]ptrace.Span, nestedSpans map[string]bool) (string, bool) {
+	isEntry := func(span ptrace.Span) bool {
+		return startsTransaction(span) && !nestedSpans[span.SpanID().String()]
+	}
+	if isEntry(span) {
+		return span.SpanID().String(), true
+	}
+	entrySpanID := ""
+	forEachAncestor(span.SpanID().String(), getKnownParentID(spansByID), func(parentID string) bool {
+		if isEntry(spansByID[parentID]) {
+			entrySpanID = parentID
+		}
+		return entrySpanID == ""
+	})
+	return entrySpanID, entrySpanID != ""
+}
+
+// forEachAncestor calls visit with the ID of each ancestor of a span, nearest first, until visit returns false or
+// no parent is found. Each ancestor is visited once, so that the walk ends even if the parents of the spans form
+// a cycle.
+func forEachAncestor(spanID string, getParentID func(spanID string) (string, bool), visit func(ancestorID string) bool) {
+	visited := map[string]bool{spanID: true}
+	for parentID, exists := getParentID(spanID); exists && !visited[parentID]; parentID, exists = getParentID(parentID) {
+		visited[parentID] = true
+		if !visit(parentID) {
+			return
+		}
+	}
+}
+
+// getKnownParentID returns a function finding the parent of a span of spansByID, when it is part of spansByID too.
+func getKnownParentID(spansByID map[string]ptrace.Span) func(spanID string) (string, bool) {
+	return func(spanID string) (string, bool) {
+		span, exists := spansByID[spanID]
+		if !exists || span.ParentSpanID().IsEmpty() {
+			return "", false
+		}
+		parentID := span.ParentSpanID().String()
+		_, exists = spansByID[parentID]
+		return parentID, exists
+	}
+}
+
 func (transaction *Transaction) IsRootSet() bool {
 	return (ptrace.Span{}) != transaction.RootSpan
 }
 
 func (transaction *Transaction) SetRootSpan(span ptrace.Span) bool {
-	// favor server/consumer/producer span
-	if transaction.IsRootSet() && (transaction.RootSpan.Kind() == ptrace.SpanKindServer ||
-		transaction.RootSpan.Kind() == ptrace.SpanKindConsumer) {
+	// favor server/consumer span, and the root span of a background job over the entry spans below it
+	if transaction.IsRootSet() && startsTransaction(transaction.RootSpan) && !isBackgroundRootSpan(span) {
 		return false
 	}
 	transaction.RootSpan = span
@@ -134,20 +480,39 @@ func (transaction *Transaction) SetRootSpan(span ptrace.Span) bool {
 }
 
 func (transaction *Transaction) AddSpan(span ptrace.Span) {
-	if span.Kind() == ptrace.SpanKindServer || span.Kind() == ptrace.SpanKindConsumer {
+	if !span.ParentSpanID().IsEmpty() {
+		transaction.spanParents[span.SpanID().String()] = span.ParentSpanID().String()
+	}
+	transaction.spans = append(transaction.spans, span)
+	if isEntrySpan(span) || span.ParentSpanID().IsEmpty() {
 		transaction.SetRootSpan(span)
+	}
+}
+
+// buildMeasurements builds the measurements of the spans and the time ranges of their children, once all the
+// spans of the transaction are known and it was split by entry span.
+func (transaction *Transaction) buildMeasurements() {
+	if transaction.measured {
 		return
 	}
-	isRoot := span.ParentSpanID().IsEmpty() && transaction.SetRootSpan(span)
+	transaction.measured = true
+	for _, span := range transaction.spans {
+		transaction.measureSpan(span)
+	}
+}
+
+func (transaction *Transaction) measureSpan(span ptrace.Span) {
+	transaction.exceptions = append(transaction.exceptions, GetExceptionEvents(span)...)
+	if isEntrySpan(span) {
+		return
+	}
+	// the call of a client or producer root span is measured, as one of the orphan spans
+	isRoot := span.ParentSpanID().IsEmpty() && span.SpanID() == transaction.RootSpan.SpanID() &&
+		span.Kind() != ptrace.SpanKindClient && span.Kind() != ptrace.SpanKindProducer
 	if !isRoot {
 		parentSpanID := span.ParentSpanID().String()
-		newDuration := DurationInNanos(span)
-
-		if measurement, exists := transaction.Measurements[parentSpanID]; exists {
-			measurement.ExclusiveDurationNanos -= newDuration
-		} else {
-			transaction.SpanToChildDuration[parentSpanID] += newDuration
-		}
+		transaction.SpanToChildIntervals[parentSpanID] = append(transaction.SpanToChildIntervals[parentSpanID],
+			TimeInterval{Start: span.StartTimestamp(), End: span.EndTimestamp()})
 	}
 
 	if span.Kind() == ptrace.SpanKindClient {
@@ -158,6 +523,9 @@ func (transaction *Transaction) AddSpan(span ptrace.Span) {
 			}
 		}
 	}
+	if span.Kind() == ptrace.SpanKindProducer && !isRoot && transaction.ProcessMessagingSpan(span) {
+		return
+	}
 	transaction.ProcessGenericSpan(span)
 }
 
@@ -167,11 +535,6 @@ func NewSimpleNameProvider(name string) func(TransactionType) string {
 
 func (transaction *Transaction) AddMeasurement(measurement *Measurement) {
 	transaction.Measurements[measurement.SpanID] = measurement
-	measurement.ExclusiveDurationNanos = measurement.ExclusiveTime(transaction)
-	if measurement.ExclusiveDurationNanos < 0 {
-		// FIXME log this
-		measurement.ExclusiveDurationNanos = 0
-	}
 	measurement.Attributes.PutStr("metricTimesliceName", measurement.MetricTimesliceName)
 }
 
@@ -184,28 +547,13 @@ func CopyAttributes(keys []string, from pcommon.Map, to pcommon.Map) {
 }
 
 func (transaction *Transaction) ProcessDatabaseSpan(span ptrace.Span) bool {
-	dbSystem, dbSystemPresent := span.Attributes().Get(DbSystemAttributeName)
-	if !dbSystemPresent {
+	attributes, timesliceName, isDatastore := GetDatastoreAttributes(span.Attributes())
+	if !isDatastore {
 		return false
 	}
-	dbOperation, dbOperationPresent := span.Attributes().Get(DbOperationAttributeName)
-	if !dbOperationPresent {
-		return false
-	}
-	dbTable, dbTablePresent := span.Attributes().Get(DbSQLTableAttributeName)
-	if !dbTablePresent {
-		dbTable = pcommon.NewValueStr("unknown")
-	}
-	attributes := pcommon.NewMap()
-	attributes.EnsureCapacity(10)
-	attributes.PutStr(DbOperationAttributeName, dbOperation.AsString())
-	attributes.PutStr(DbSystemAttributeName, dbSystem.AsString())
-	attributes.PutStr(DbSQLTableAttributeName, dbTable.AsString())
-	CopyAttributes([]string{"server.address", "server.port", "net.peer.name", "db.name"}, span.Attributes(), attributes)
-
-	timesliceName := fmt.Sprintf("Datastore/statement/%s/%s/%s", dbSystem.AsString(), dbTable.AsString(), dbOperation.AsString())
+	dbSystem, _ := attributes.Get(DbSystemAttributeName)
 	measurement := Measurement{SpanID: span.SpanID().String(), MetricName: "apm.service.datastore.operation.duration", Span: span,
-		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider(dbSystem.AsString()), MetricTimesliceName: timesliceName}
+		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider(dbSystem.Str()), MetricTimesliceName: timesliceName}
 
 	transaction.AddMeasurement(&measurement)
 
@@ -238,6 +586,33 @@ func (transaction *Transaction) ProcessExternalSpan(span ptrace.Span) bool {
 	return false
 }
 
+func (transaction *Transaction) ProcessMessagingSpan(span ptrace.Span) bool {
+	messagingSystem, messagingSystemPresent := span.Attributes().Get(MessagingSystemAttributeName)
+	if !messagingSystemPresent {
+		return false
+	}
+	operation := GetMessagingOperation(span.Attributes())
+	destinationKind := GetMessagingDestinationKind(span.Attributes(), messagingSystem.AsString())
+
+	attributes := pcommon.NewMap()
+	attributes.PutStr(MessagingSystemAttributeName, messagingSystem.AsString())
+	attributes.PutStr("messaging.operation", operation)
+	attributes.PutStr("messaging.destination.kind", destinationKind)
+	destination := "Temp"
+	if destinationName, isNamed := GetMessagingDestinationName(span.Attributes()); isNamed {
+		attributes.PutStr(MessagingDestinationNameAttributeName, destinationName)
+		destination = fmt.Sprintf("Named/%s", destinationName)
+	}
+
+	timesliceName := fmt.Sprintf("MessageBroker/%s/%s/%s/%s", messagingSystem.AsString(), destinationKind, operation, destination)
+	measurement := Measurement{SpanID: span.SpanID().String(), MetricName: "apm.service.messaging.operation.duration", Span: span,
+		DurationNanos: DurationInNanos(span), Attributes: attributes, SegmentNameProvider: NewSimpleNameProvider("Messaging"), MetricTimesliceName: timesliceName}
+
+	transaction.AddMeasurement(&measurement)
+
+	return true
+}
+
 func (transaction *Transaction) ProcessGenericSpan(span ptrace.Span) bool {
 	attributes := pcommon.NewMap()
 	timesliceName := fmt.Sprintf("Custom/%s", span.Name())
@@ -250,39 +625,63 @@ func (transaction *Transaction) ProcessGenericSpan(span ptrace.Span) bool {
 }
 
 func (transaction *Transaction) ProcessClientSpan(span ptrace.Span) bool {
-	return transaction.ProcessDatabaseSpan(span) || transaction.ProcessExternalSpan(span)
+	return transaction.ProcessDatabaseSpan(span) || transaction.ProcessMessagingSpan(span) || transaction.ProcessExternalSpan(span)
 }
 
 func (transaction *Transaction) ProcessRootSpan() bool {
+	transaction.buildMeasurements()
 	if !transaction.IsRootSet() {
 		return false
 	}
 	span := transaction.RootSpan
 
-	transactionName, transactionType := GetTransactionMetricName(span)
+	nameSpan := span
+	if (ptrace.Span{}) != transaction.nameSpan {
+		nameSpan = transaction.nameSpan
+	}
+	transactionName, transactionType := GetNormalizedTransactionMetricName(nameSpan, transaction.urlNormalizer)
+	// no SDK emits duration metrics for background work, such as scheduled jobs
+	deriveMetricsFromSpans := transaction.deriveMetricsFromSpans
+	if span.Kind() == ptrace.SpanKindInternal {
+		transactionName, transactionType = GetBackgroundTransactionMetricName(span, transaction.rootScopeName, transaction.backgroundTransactionName)
+		deriveMetricsFromSpans = true
+	}
 	if transactionType == NullTransactionType {
-		return true
+		// a client or producer root span is not the start of a transaction, its parent was never seen
+		return false
 	}
 
-	// TODO: Error count and Apdex are calculated from metrics now. Though, the plan is to bring the following code
-	// back for languages like Ruby that do not yet generate metric data.
-	//err := span.Status().Code() == ptrace.StatusCodeError
-	//if err {
-	//	transaction.IncrementErrorCount(transactionName, transactionType, span.StartTimestamp(), span.EndTimestamp())
-	//}
-	//
-	//transaction.GenerateApdexMetrics(span, err, transactionName, transactionType)
+	errorKind := transaction.errorClassifier.ClassifySpan(span)
+	if errorKind == Error {
+		errorClass, errorMessage := GetErrorClass(span, transaction.exceptions, transaction.spanParents, transaction.errorClasses.attribution)
+		transaction.IncrementErrorClassCount(transactionName, transactionType, span, errorClass)
+		if transaction.logs != nil {
+			transaction.logs.AddTransactionError(transaction.resourceMetrics.attributes, span, transactionName, transactionType, errorClass, errorMessage)
+		}
+	}
+
+	// Error count and Apdex are calculated from metrics, unless the SDK does not generate metric data
+	if deriveMetricsFromSpans {
+		if errorKind != NotAnError {
+			transaction.IncrementErrorCount(errorKind, transactionName, transactionType, span.StartTimestamp(), span.EndTimestamp())
+		}
+
+		transaction.GenerateApdexMetrics(span, errorKind == Error, transactionName, transactionType)
+	}
 
 	breakdownBySegment := make(map[string]int64)
-	totalBreakdownNanos := int64(0)
 	for _, measurement := range transaction.Measurements {
+		// children may have been added after the measurement, exclusive time is only known now
+		measurement.ExclusiveDurationNanos = measurement.ExclusiveTime(transaction)
 		transaction.ProcessMeasurement(measurement, transactionType, transactionName)
 		segmentName := measurement.SegmentNameProvider(transactionType)
 		breakdownBySegment[segmentName] += measurement.ExclusiveDurationNanos
-		totalBreakdownNanos += measurement.ExclusiveDurationNanos
 	}
 
-	remainingNanos := DurationInNanos(span) - totalBreakdownNanos
+	remainingNanos := int64(0)
+	if _, exists := transaction.Measurements[span.SpanID().String()]; !exists {
+		remainingNanos = transaction.RootExclusiveTime()
+	}
 	if remainingNanos > 0 {
 		breakdownBySegment[transaction.SdkLanguage] += remainingNanos
 	}
@@ -300,9 +699,10 @@ func (transaction *Transaction) ProcessRootSpan() bool {
 		attributes.PutStr("transactionName", transactionName)
 		attributes.PutStr("metricTimesliceName", transactionName)
 
-		// TODO: Transaction duration is now calculated from metrics. Though, the plan is to bring the following code
-		// back for languages like Ruby that do not yet generate metric data.
-		// transaction.resourceMetrics.AddHistogramFromSpan("apm.service.transaction.duration", attributes, span)
+		// Transaction duration is calculated from metrics, unless the SDK does not generate metric data
+		if deriveMetricsFromSpans {
+			transaction.resourceMetrics.AddHistogramFromSpan("apm.service.transaction.duration", attributes, span)
+		}
 		transaction.resourceMetrics.AddHistogramFromSpan("apm.service.transaction.sampled_duration", attributes, span)
 
 		if remainingNanos > 0 {
@@ -313,39 +713,84 @@ func (transaction *Transaction) ProcessRootSpan() bool {
 		}
 	}
 
+	if transaction.logs != nil {
+		transaction.logs.AddTransaction(transaction, transactionName, transactionType, errorKind == Error)
+	}
+
 	return true
 }
 
+// ProcessOrphanSpans counts the transaction and its spans when its root span was never seen, as when the root
+// span is dropped or sent in another batch. When transactionName is set, the datastore, external and messaging
+// measurements of the spans are recorded with it, instead of being dropped.
+func (transaction *Transaction) ProcessOrphanSpans(transactionName string) {
+	if len(transaction.spans) == 0 {
+		return
+	}
+	transaction.buildMeasurements()
+	start, end := transaction.spans[0].StartTimestamp(), transaction.spans[0].EndTimestamp()
+	for _, span := range transaction.spans {
+		if span.StartTimestamp() < start {
+			start = span.StartTimestamp()
+		}
+		if span.EndTimestamp() > end {
+			end = span.EndTimestamp()
+		}
+	}
+	transaction.resourceMetrics.IncrementMonotonicSum(orphanTransactionMetricName, pcommon.NewMap(), start, end)
+	transaction.resourceMetrics.GetSum(orphanSpanMetricName, pcommon.NewMap(), true, start, end).Add(int64(len(transaction.spans)), start, end)
+
+	if transactionName == "" {
+		return
+	}
+	transactionType := WebTransactionType
+	if strings.HasPrefix(transactionName, "OtherTransaction/") {
+		transactionType = OtherTransactionType
+	}
+	for _, measurement := range transaction.Measurements {
+		if !orphanMeasurementMetrics[measurement.MetricName] {
+			continue
+		}
+		measurement.Attributes.PutStr("transactionType", transactionType.AsString())
+		measurement.Attributes.PutStr("scope", transactionName)
+		transaction.resourceMetrics.AddHistogramFromSpan(measurement.MetricName, measurement.Attributes, measurement.Span)
+	}
+}
+
 func (transaction *Transaction) GenerateApdexMetrics(span ptrace.Span, err bool, transactionName string, transactionType TransactionType) {
+	apdex := transaction.apdexRules.GetApdex(transaction.serviceName, transactionName)
 	attributes := pcommon.NewMap()
-	attributes.PutDouble("apdex.value", transaction.apdex.apdexSatisfying)
+	attributes.PutDouble("apdex.value", apdex.apdexSatisfying)
 	attributes.PutStr("transactionType", transactionType.AsString())
 	if err {
 		attributes.PutStr("apdex.zone", "F")
 	} else {
 		durationSeconds := NanosToSeconds(DurationInNanos(span))
-		attributes.PutStr("apdex.zone", transaction.apdex.GetApdexZone(durationSeconds))
+		attributes.PutStr("apdex.zone", apdex.GetApdexZone(durationSeconds))
 	}
-	transaction.resourceMetrics.IncrementSum("apm.service.apdex", attributes, span.StartTimestamp(), span.EndTimestamp())
+	transaction.resourceMetrics.IncrementMonotonicSum("apm.service.apdex", attributes, span.StartTimestamp(), span.EndTimestamp())
 
 	txAttributes := pcommon.NewMap()
 	attributes.CopyTo(txAttributes)
 	txAttributes.PutStr("transactionName", transactionName)
-	transaction.resourceMetrics.IncrementSum("apm.service.transaction.apdex", txAttributes, span.StartTimestamp(), span.EndTimestamp())
+	transaction.resourceMetrics.IncrementMonotonicSum("apm.service.transaction.apdex", txAttributes, span.StartTimestamp(), span.EndTimestamp())
 }
 
-func (transaction *Transaction) IncrementErrorCount(transactionName string, transactionType TransactionType, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) {
-	{
-		attributes := pcommon.NewMap()
-		attributes.PutStr("transactionType", transactionType.AsString())
-		transaction.resourceMetrics.IncrementSum("apm.service.error.count", attributes, startTimestamp, endTimestamp)
-	}
-	{
-		attributes := pcommon.NewMap()
-		attributes.PutStr("transactionName", transactionName)
-		attributes.PutStr("transactionType", transactionType.AsString())
-		transaction.resourceMetrics.IncrementSum("apm.service.transaction.error.count", attributes, startTimestamp, endTimestamp)
+func (transaction *Transaction) IncrementErrorCount(errorKind ErrorKind, transactionName string, transactionType TransactionType, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) {
+	recordErrorCounts(transaction.resourceMetrics, errorKind, transactionName, transactionType, startTimestamp, endTimestamp, 1)
+}
+
+// IncrementErrorClassCount counts a failed transaction by the class of its error. Once a service has reached
+// the maximum number of error classes, errors of new classes are counted as `Other`.
+func (transaction *Transaction) IncrementErrorClassCount(transactionName string, transactionType TransactionType, span ptrace.Span, errorClass string) {
+	if !transaction.cardinalityLimits.admitErrorClass(transaction.serviceName, errorClass, transaction.errorClasses.maxClasses) {
+		errorClass = overflowErrorClass
 	}
+	attributes := pcommon.NewMap()
+	attributes.PutStr("transactionType", transactionType.AsString())
+	attributes.PutStr("transactionName", transactionName)
+	attributes.PutStr(ErrorClassAttributeName, errorClass)
+	transaction.resourceMetrics.GetSum("apm.service.transaction.error.class.count", attributes, true, span.StartTimestamp(), span.EndTimestamp()).Add(1, span.StartTimestamp(), span.EndTimestamp())
 }
 
 func (transaction *Transaction) ProcessMeasurement(measurement *Measurement, transactionType TransactionType, transactionName string) {
@@ -369,35 +814,94 @@ func DurationInNanos(span ptrace.Span) int64 {
 	return (span.EndTimestamp() - span.StartTimestamp()).AsTime().UnixNano()
 }
 
+// ExclusiveTime returns the time of the span during which none of its children was running. Children running
+// concurrently are only counted once, and the time children run after the end of the span is not counted.
 func (measurement Measurement) ExclusiveTime(transaction *Transaction) int64 {
-	childDurationNanos := transaction.SpanToChildDuration[measurement.SpanID]
-	// we no longer need the summed child durations, delete that
-	delete(transaction.SpanToChildDuration, measurement.SpanID)
-	return measurement.DurationNanos - childDurationNanos
+	return GetExclusiveDuration(measurement.Span, transaction.SpanToChildIntervals[measurement.SpanID])
 }
 
-func GetTransactionMetricNameFromAttributes(p pcommon.Map) (string, TransactionType) {
-	name, txType := GetServerTransactionMetricName(p)
+// RootExclusiveTime returns the exclusive time of the root span. The children of spans that are not part of
+// the transaction count as children of the root span.
+func (transaction *Transaction) RootExclusiveTime() int64 {
+	rootSpanID := transaction.RootSpan.SpanID().String()
+	var children []TimeInterval
+	for parentSpanID, intervals := range transaction.SpanToChildIntervals {
+		if _, exists := transaction.Measurements[parentSpanID]; parentSpanID == rootSpanID || !exists {
+			children = append(children, intervals...)
+		}
+	}
+	return GetExclusiveDuration(transaction.RootSpan, children)
+}
+
+// GetExclusiveDuration returns the duration of the span minus the duration of the union of the children
+// intervals, within the span.
+func GetExclusiveDuration(span ptrace.Span, children []TimeInterval) int64 {
+	start, end := span.StartTimestamp(), span.EndTimestamp()
+	if end <= start {
+		return 0
+	}
+	sorted := make([]TimeInterval, len(children))
+	copy(sorted, children)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	// children are sorted by start, only the part of each child after the end of the previous ones is counted
+	coveredNanos := int64(0)
+	coveredUntil := start
+	for _, child := range sorted {
+		childStart, childEnd := child.Start, child.End
+		if childStart < coveredUntil {
+			childStart = coveredUntil
+		}
+		if childEnd > end {
+			childEnd = end
+		}
+		if childEnd > childStart {
+			coveredNanos += int64(childEnd - childStart)
+			coveredUntil = childEnd
+		}
+	}
+	return int64(end-start) - coveredNanos
+}
+
+func GetTransactionMetricNameFromAttributes(p pcommon.Map, urlNormalizer *URLNormalizer) (string, TransactionType) {
+	name, txType := GetServerTransactionMetricName(p, urlNormalizer)
 	if txType == NullTransactionType {
 		return "WebTransaction/Other/Unknown", WebTransactionType
 	}
 	return name, txType
 }
 
+// GetTransactionMetricName returns the name of the transaction of a root span, URL paths are normalized with the default rules.
 func GetTransactionMetricName(span ptrace.Span) (string, TransactionType) {
+	return GetNormalizedTransactionMetricName(span, defaultURLNormalizer)
+}
+
+func GetNormalizedTransactionMetricName(span ptrace.Span, urlNormalizer *URLNormalizer) (string, TransactionType) {
 	if span.Kind() == ptrace.SpanKindConsumer {
 		return GetConsumerTransactionMetricName(span.Attributes())
 	}
 	if span.Kind() != ptrace.SpanKindServer {
 		return "", NullTransactionType
 	}
-	name, txType := GetServerTransactionMetricName(span.Attributes())
+	name, txType := GetServerTransactionMetricName(span.Attributes(), urlNormalizer)
 	if txType == NullTransactionType {
 		return fmt.Sprintf("WebTransaction/Other/%s", span.Name()), WebTransactionType
 	}
 	return name, txType
 }
 
+// GetBackgroundTransactionMetricName returns the name of the transaction of a root internal span, such as a
+// scheduled job. In the name, {scope} and {span} are replaced with the instrumentation scope and the span name.
+func GetBackgroundTransactionMetricName(span ptrace.Span, scopeName string, name string) (string, TransactionType) {
+	if name == "" {
+		name = defaultBackgroundTransactionName
+	}
+	if scopeName == "" {
+		scopeName = "unknown"
+	}
+	return strings.NewReplacer("{scope}", scopeName, "{span}", span.Name()).Replace(name), OtherTransactionType
+}
+
 func GetConsumerTransactionMetricName(attributes pcommon.Map) (string, TransactionType) {
 	system, systemPresent := attributes.Get("messaging.system")
 	if !systemPresent {
@@ -408,15 +912,15 @@ func GetConsumerTransactionMetricName(attributes pcommon.Map) (string, Transacti
 	if !destinationNamePresent {
 		destinationName = pcommon.NewValueStr("unknown")
 	}
-	operation, operationPresent := attributes.Get("messaging.operation")
-	if !operationPresent {
+	operation, _ := GetFirst(attributes, messagingOperationAttributes)
+	if operation.Type() == pcommon.ValueTypeEmpty {
 		operation = pcommon.NewValueStr("unknown")
 	}
 
 	return fmt.Sprintf("OtherTransaction/Consumer/%s/%s/%s", system.AsString(), destinationName.AsString(), operation.AsString()), OtherTransactionType
 }
 
-func GetServerTransactionMetricName(attributes pcommon.Map) (string, TransactionType) {
+func GetServerTransactionMetricName(attributes pcommon.Map, urlNormalizer *URLNormalizer) (string, TransactionType) {
 	if rpcService, rpcServicePresent := attributes.Get("rpc.service"); rpcServicePresent {
 		if rpcMethod, rpcMethodPresent := attributes.Get("rpc.method"); rpcMethodPresent {
 			return fmt.Sprintf("WebTransaction/rpc/%s/%s", rpcService.AsString(), rpcMethod.AsString()), WebTransactionType
@@ -427,7 +931,7 @@ func GetServerTransactionMetricName(attributes pcommon.Map) (string, Transaction
 		return GetWebTransactionMetricName(attributes, httpRoute.Str(), "http.route")
 	}
 	if urlPath, _ := GetFirst(attributes, []string{"url.path", "http.target"}); urlPath.Type() != pcommon.ValueTypeEmpty {
-		return GetWebTransactionMetricName(attributes, urlPath.Str(), "Uri")
+		return GetWebTransactionMetricName(attributes, urlNormalizer.Normalize(urlPath.Str()), "Uri")
 	}
 
 	if method, methodPresent := GetHTTPMethod(attributes); methodPresent {
@@ -436,6 +940,53 @@ func GetServerTransactionMetricName(attributes pcommon.Map) (string, Transaction
 	return "", NullTransactionType
 }
 
+// the generic operation of messaging spans and metrics, `messaging.operation` before semantic conventions 1.26
+var messagingOperationAttributes = []string{"messaging.operation", "messaging.operation.type"}
+
+// messaging systems whose destinations are topics rather than queues
+var topicMessagingSystems = []string{"kafka", "pulsar", "aws_sns", "gcp_pubsub", "eventgrid"}
+
+// GetMessagingOperation returns `Consume` for the operations receiving messages, `Produce` otherwise.
+func GetMessagingOperation(attributes pcommon.Map) string {
+	operation, _ := GetFirst(attributes, messagingOperationAttributes)
+	switch operation.AsString() {
+	case "receive", "process", "deliver":
+		return "Consume"
+	default:
+		return "Produce"
+	}
+}
+
+// GetMessagingDestinationKind returns `Topic` or `Queue`, from messaging.destination.kind when known.
+func GetMessagingDestinationKind(attributes pcommon.Map, messagingSystem string) string {
+	if kind, exists := attributes.Get("messaging.destination.kind"); exists {
+		if strings.EqualFold(kind.AsString(), "topic") {
+			return "Topic"
+		}
+		return "Queue"
+	}
+	for _, system := range topicMessagingSystems {
+		if system == messagingSystem {
+			return "Topic"
+		}
+	}
+	return "Queue"
+}
+
+// GetMessagingDestinationName returns the name of the destination, unless it is temporary or anonymous.
+func GetMessagingDestinationName(attributes pcommon.Map) (string, bool) {
+	for _, key := range []string{"messaging.destination.temporary", "messaging.destination.anonymous"} {
+		if value, exists := attributes.Get(key); exists && value.Type() == pcommon.ValueTypeBool && value.Bool() {
+			return "", false
+		}
+	}
+	destinationName, exists := attributes.Get(MessagingDestinationNameAttributeName)
+	if !exists || destinationName.AsString() == "" {
+		return "", false
+	}
+	return destinationName.AsString(), true
+}
+
 func GetServerAddress(attributes pcommon.Map) (string, bool) {
 	serverAddress, _ := GetFirst(attributes, []string{"server.address", "net.peer.name"})
 	if serverAddress.Type() == pcommon.ValueTypeEmpty {
@@ -444,6 +995,32 @@ func GetServerAddress(attributes pcommon.Map) (string, bool) {
 	return serverAddress.Str(), true
 }
 
+// GetDatastoreAttributes returns the attributes and the timeslice name of a database call, from the attributes
+// of a span or of a metric datapoint. The system and the operation are required, the table is unknown when missing.
+func GetDatastoreAttributes(from pcommon.Map) (pcommon.Map, string, bool) {
+	dbSystem, _ := GetFirst(from, []string{DbSystemAttributeName, "db.system.name"})
+	if dbSystem.Type() == pcommon.ValueTypeEmpty {
+		return pcommon.Map{}, "", false
+	}
+	dbOperation, _ := GetFirst(from, []string{DbOperationAttributeName, "db.operation.name"})
+	if dbOperation.Type() == pcommon.ValueTypeEmpty {
+		return pcommon.Map{}, "", false
+	}
+	dbTable, _ := GetFirst(from, []string{DbSQLTableAttributeName, "db.collection.name", "db.mongodb.collection", "db.cassandra.table"})
+	if dbTable.Type() == pcommon.ValueTypeEmpty {
+		dbTable = pcommon.NewValueStr("unknown")
+	}
+	attributes := pcommon.NewMap()
+	attributes.EnsureCapacity(10)
+	attributes.PutStr(DbOperationAttributeName, dbOperation.AsString())
+	attributes.PutStr(DbSystemAttributeName, dbSystem.AsString())
+	attributes.PutStr(DbSQLTableAttributeName, dbTable.AsString())
+	CopyAttributes([]string{"server.address", "server.port", "net.peer.name", "db.name"}, from, attributes)
+
+	timesliceName := fmt.Sprintf("Datastore/statement/%s/%s/%s", dbSystem.AsString(), dbTable.AsString(), dbOperation.AsString())
+	return attributes, timesliceName, true
+}
+
 func GetHTTPMethod(attributes pcommon.Map) (string, bool) {
 	method, _ := GetFirst(attributes, []string{"http.request.method", "http.method"})
 	if method.Type() == pcommon.ValueTypeEmpty {
@@ -468,6 +1045,13 @@ func GetFirst(attributes pcommon.Map, keys []string) (pcommon.Value, string) {
 	return pcommon.NewValueEmpty(), ""
 }
 
+func GetServiceName(attributes pcommon.Map) string {
+	if serviceName, serviceNamePresent := attributes.Get("service.name"); serviceNamePresent {
+		return serviceName.AsString()
+	}
+	return ""
+}
+
 func GetSdkLanguage(attributes pcommon.Map) string {
 	sdkLanguage, sdkLanguagePresent := attributes.Get("telemetry.sdk.language")
 	if sdkLanguagePresent {
@@ -475,11 +1059,3 @@ func GetSdkLanguage(attributes pcommon.Map) string {
 	}
 	return "unknown"
 }
-
-// Generate the metrc used for the host instances drop down
-func GenerateInstanceMetric(resourceMetrics *ResourceMetrics, hostName string, startTimestamp pcommon.Timestamp, endTimestamp pcommon.Timestamp) {
-	attributes := pcommon.NewMap()
-	attributes.PutStr("instanceName", hostName)
-	attributes.PutStr("host.displayName", hostName)
-	resourceMetrics.IncrementSum("apm.service.instance.count", pcommon.NewMap(), startTimestamp, endTimestamp)
-}
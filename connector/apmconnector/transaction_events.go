@@ -0,0 +1,125 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+)
+
+const (
+	transactionEvent = "apm.transaction"
+
+	defaultMaxTransactionEvents = 1000
+)
+
+// TransactionEvents keeps a uniform sample of the transactions of each resource until they are flushed,
+// as one log record per transaction.
+type TransactionEvents struct {
+	maxSamples int
+	random     *rand.Rand
+	reservoirs map[string]*eventReservoir
+}
+
+// eventReservoir is a reservoir sample of the events of a resource.
+type eventReservoir struct {
+	resourceAttributes pcommon.Map
+	seen               int
+	events             []plog.LogRecord
+}
+
+func NewTransactionEvents(config TransactionEventsConfig) *TransactionEvents {
+	maxSamples := config.MaxSamples
+	if maxSamples == 0 {
+		maxSamples = defaultMaxTransactionEvents
+	}
+	return &TransactionEvents{maxSamples: maxSamples, random: rand.New(rand.NewSource(time.Now().UnixNano())),
+		reservoirs: make(map[string]*eventReservoir)}
+}
+
+// Offer adds the transaction to the sample of its resource. The event is only built when sampled.
+func (transactionEvents *TransactionEvents) Offer(transaction *Transaction, transactionName string, transactionType TransactionType, isError bool) {
+	resourceAttributes := transaction.resourceMetrics.attributes
+	key := getKeyFromMap(resourceAttributes)
+	reservoir, exists := transactionEvents.reservoirs[key]
+	if !exists {
+		reservoir = &eventReservoir{resourceAttributes: resourceAttributes}
+		transactionEvents.reservoirs[key] = reservoir
+	}
+
+	reservoir.seen++
+	if len(reservoir.events) < transactionEvents.maxSamples {
+		reservoir.events = append(reservoir.events, newTransactionEventRecord(transaction, transactionName, transactionType, isError))
+		return
+	}
+	if i := transactionEvents.random.Intn(reservoir.seen); i < transactionEvents.maxSamples {
+		reservoir.events[i] = newTransactionEventRecord(transaction, transactionName, transactionType, isError)
+	}
+}
+
+// Flush adds the sampled events to the logs and starts new samples. Each event carries the number of
+// transactions it stands for, in the sampleWeight attribute.
+func (transactionEvents *TransactionEvents) Flush(logs *Logs) {
+	for _, reservoir := range transactionEvents.reservoirs {
+		sampleWeight := float64(reservoir.seen) / float64(len(reservoir.events))
+		for _, event := range reservoir.events {
+			record := logs.AppendLogRecord(reservoir.resourceAttributes)
+			event.CopyTo(record)
+			record.Attributes().PutDouble("sampleWeight", sampleWeight)
+		}
+	}
+	transactionEvents.reservoirs = make(map[string]*eventReservoir)
+}
+
+// newTransactionEventRecord creates a log record describing a transaction. The attributes of the root span are
+// kept, so that events can be queried by any of them.
+func newTransactionEventRecord(transaction *Transaction, transactionName string, transactionType TransactionType, isError bool) plog.LogRecord {
+	span := transaction.RootSpan
+	record := plog.NewLogRecord()
+	record.SetTimestamp(span.EndTimestamp())
+	record.SetObservedTimestamp(span.EndTimestamp())
+	record.SetSeverityNumber(plog.SeverityNumberInfo)
+	record.SetSeverityText("INFO")
+	record.SetTraceID(span.TraceID())
+	record.SetSpanID(span.SpanID())
+
+	attributes := record.Attributes()
+	span.Attributes().CopyTo(attributes)
+	attributes.PutStr(EventNameAttributeName, transactionEvent)
+	attributes.PutStr("transactionName", transactionName)
+	attributes.PutStr("transactionType", transactionType.AsString())
+	durationSeconds := NanosToSeconds(DurationInNanos(span))
+	attributes.PutDouble("duration", durationSeconds)
+	if isError {
+		attributes.PutStr("apdex.zone", "F")
+	} else {
+		attributes.PutStr("apdex.zone", transaction.apdexRules.GetApdex(transaction.serviceName, transactionName).GetApdexZone(durationSeconds))
+	}
+	attributes.PutBool("error", isError)
+	if statusCode, exists := getIntAttribute(span.Attributes(), "http.response.status_code", "http.status_code"); exists {
+		attributes.PutInt("http.response.status_code", statusCode)
+	}
+
+	databaseCallCount, externalCallCount := int64(0), int64(0)
+	databaseNanos, externalNanos := int64(0), int64(0)
+	for _, measurement := range transaction.Measurements {
+		switch measurement.MetricName {
+		case "apm.service.datastore.operation.duration":
+			databaseCallCount++
+			databaseNanos += measurement.DurationNanos
+		case "apm.service.transaction.external.host.duration":
+			externalCallCount++
+			externalNanos += measurement.DurationNanos
+		}
+	}
+	attributes.PutInt("databaseCallCount", databaseCallCount)
+	attributes.PutDouble("databaseDuration", NanosToSeconds(databaseNanos))
+	attributes.PutInt("externalCallCount", externalCallCount)
+	attributes.PutDouble("externalDuration", NanosToSeconds(externalNanos))
+	attributes.PutStr("trace.id", span.TraceID().String())
+	return record
+}
@@ -0,0 +1,93 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+func TestTransactionEvent(t *testing.T) {
+	end := time.Unix(1000, 0)
+	traces := newTestTraces()
+	spans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	root := spans.AppendEmpty()
+	setTestSpan(root, "GET /users", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	root.Attributes().PutStr("customer.tier", "gold")
+	root.Attributes().PutInt("http.status_code", 200)
+	for i, spanID := range []byte{2, 3} {
+		database := spans.AppendEmpty()
+		setTestSpan(database, "SELECT users", spanID, 1, ptrace.SpanKindClient, end.Add(-time.Second), end.Add(time.Duration(i-2)*100*time.Millisecond))
+		database.Attributes().PutStr("db.system", "postgresql")
+		database.Attributes().PutStr("db.operation", "SELECT")
+	}
+	external := spans.AppendEmpty()
+	setTestSpan(external, "GET", 4, 1, ptrace.SpanKindClient, end.Add(-time.Second), end.Add(-500*time.Millisecond))
+	external.Attributes().PutStr("server.address", "example.com")
+
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
+	metrics := NewMetrics()
+	logs := NewLogs()
+	logs.transactionEvents = NewTransactionEvents(TransactionEventsConfig{})
+	transactions.AddTraces(zap.NewNop(), NewAttributeFilter(nil, nil), metrics, traces, time.Now())
+	transactions.ProcessCompletedTransactions(metrics, logs, time.Now(), 0, 0, true)
+	assert.Equal(t, 0, logs.LogRecordCount())
+
+	logs.transactionEvents.Flush(logs)
+	assert.Equal(t, 1, logs.LogRecordCount())
+	record := logs.OtelLogs().ResourceLogs().At(0).ScopeLogs().At(0).LogRecords().At(0)
+	assert.Equal(t, root.TraceID(), record.TraceID())
+	assert.Equal(t, map[string]any{
+		"customer.tier":             "gold",
+		"http.status_code":          int64(200),
+		"event.name":                "apm.transaction",
+		"transactionName":           "WebTransaction/Other/GET /users",
+		"transactionType":           "Web",
+		"duration":                  1.0,
+		"apdex.zone":                "T",
+		"error":                     false,
+		"http.response.status_code": int64(200),
+		"databaseCallCount":         int64(2),
+		"databaseDuration":          1.7,
+		"externalCallCount":         int64(1),
+		"externalDuration":          0.5,
+		"trace.id":                  root.TraceID().String(),
+		"sampleWeight":              1.0,
+	}, record.Attributes().AsRaw())
+}
+
+func TestTransactionEventsReservoir(t *testing.T) {
+	transactionEvents := NewTransactionEvents(TransactionEventsConfig{MaxSamples: 2})
+	metrics := NewMetrics()
+	resourceMetrics := metrics.GetOrCreateResource(pcommon.NewMap())
+	end := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		transaction := &Transaction{resourceMetrics: resourceMetrics, Measurements: make(map[string]*Measurement)}
+		root := ptrace.NewSpan()
+		setTestSpan(root, "root", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+		root.SetTraceID(pcommon.TraceID{byte(i + 1)})
+		transaction.RootSpan = root
+		transactionEvents.Offer(transaction, "WebTransaction/Other/root", WebTransactionType, true)
+	}
+
+	logs := NewLogs()
+	transactionEvents.Flush(logs)
+	records := logs.OtelLogs().ResourceLogs().At(0).ScopeLogs().At(0).LogRecords()
+	assert.Equal(t, 2, records.Len())
+	for i := 0; i < records.Len(); i++ {
+		sampleWeight, _ := records.At(i).Attributes().Get("sampleWeight")
+		assert.Equal(t, 5.0, sampleWeight.Double())
+		zone, _ := records.At(i).Attributes().Get("apdex.zone")
+		assert.Equal(t, "F", zone.Str())
+	}
+
+	logs = NewLogs()
+	transactionEvents.Flush(logs)
+	assert.Equal(t, 0, logs.LogRecordCount())
+}
@@ -5,10 +5,13 @@ package apmconnector
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
 )
 
 func TestApdex(t *testing.T) {
@@ -49,23 +52,23 @@ func TestGetTransactionMetricNameUrlPath(t *testing.T) {
 	span.Attributes().PutStr("url.path", "/owners/5")
 
 	name, txType := GetTransactionMetricName(span)
-	assert.Equal(t, "WebTransaction/Uri/owners/5", name)
+	assert.Equal(t, "WebTransaction/Uri/owners/*", name)
 	assert.Equal(t, WebTransactionType, txType)
 }
 
 func TestGetTransactionMetricNameHttpTarget(t *testing.T) {
 	span := ptrace.NewSpan()
 	span.SetKind(ptrace.SpanKindServer)
-	span.Attributes().PutStr("http.target", "/owners/5")
+	span.Attributes().PutStr("http.target", "/owners/5?page=2")
 	span.Attributes().PutStr("http.request.method", "GET")
 
 	name, txType := GetTransactionMetricName(span)
-	assert.Equal(t, "WebTransaction/Uri/owners/5 (GET)", name)
+	assert.Equal(t, "WebTransaction/Uri/owners/* (GET)", name)
 	assert.Equal(t, WebTransactionType, txType)
 }
 
 func TestGetOrCreateTransaction(t *testing.T) {
-	transactions := NewTransactionsMap(0.5)
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
 	span := ptrace.NewSpan()
 	metricMap := NewMetrics()
 	resources := pcommon.NewMap()
@@ -82,7 +85,7 @@ func TestGetOrCreateTransaction(t *testing.T) {
 }
 
 func TestGetOrCreateTransactionMultipleSpans(t *testing.T) {
-	transactions := NewTransactionsMap(0.5)
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
 	span := ptrace.NewSpan()
 	span.SetTraceID(pcommon.TraceID{0x01})
 	span.SetSpanID(pcommon.SpanID{0x01})
@@ -101,7 +104,7 @@ func TestGetOrCreateTransactionMultipleSpans(t *testing.T) {
 }
 
 func TestGetOrCreateTransactionMultipleServices(t *testing.T) {
-	transactions := NewTransactionsMap(0.5)
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
 	span := ptrace.NewSpan()
 	span.SetTraceID(pcommon.TraceID{0x01})
 	span.SetSpanID(pcommon.SpanID{0x01})
@@ -176,3 +179,317 @@ func TestGetTransactionMetricNameProducer(t *testing.T) {
 	_, txType := GetTransactionMetricName(span)
 	assert.Equal(t, NullTransactionType, txType)
 }
+
+func TestProcessMessagingSpan(t *testing.T) {
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
+	metricMap := NewMetrics()
+	resources := pcommon.NewMap()
+	metrics := metricMap.GetOrCreateResource(resources)
+	end := time.Unix(1000, 0)
+
+	root := ptrace.NewSpan()
+	setTestSpan(root, "POST /orders", 1, 0, ptrace.SpanKindServer, end.Add(-time.Second), end)
+	producer := ptrace.NewSpan()
+	setTestSpan(producer, "orders publish", 2, 1, ptrace.SpanKindProducer, end.Add(-time.Second), end)
+	producer.Attributes().PutStr("messaging.system", "kafka")
+	producer.Attributes().PutStr("messaging.destination.name", "orders")
+	producer.Attributes().PutStr("messaging.operation", "publish")
+	client := ptrace.NewSpan()
+	setTestSpan(client, "receive", 3, 1, ptrace.SpanKindClient, end.Add(-time.Second), end)
+	client.Attributes().PutStr("messaging.system", "rabbitmq")
+	client.Attributes().PutStr("messaging.destination.name", "amq.gen-JzTY20BRgKO")
+	client.Attributes().PutBool("messaging.destination.temporary", true)
+	client.Attributes().PutStr("messaging.operation", "receive")
+	client.Attributes().PutStr("server.address", "rabbitmq.example.com")
+	internal := ptrace.NewSpan()
+	setTestSpan(internal, "notify", 4, 1, ptrace.SpanKindProducer, end.Add(-time.Second), end)
+
+	transaction, _ := transactions.GetOrCreateTransaction("java", root, metrics, resources)
+	for _, span := range []ptrace.Span{root, producer, client, internal} {
+		transaction.AddSpan(span)
+	}
+	transaction.buildMeasurements()
+
+	assert.Equal(t, "MessageBroker/kafka/Topic/Produce/Named/orders", transaction.Measurements[producer.SpanID().String()].MetricTimesliceName)
+	assert.Equal(t, "apm.service.messaging.operation.duration", transaction.Measurements[producer.SpanID().String()].MetricName)
+	assert.Equal(t, "MessageBroker/rabbitmq/Queue/Consume/Temp", transaction.Measurements[client.SpanID().String()].MetricTimesliceName)
+	assert.Equal(t, "Custom/notify", transaction.Measurements[internal.SpanID().String()].MetricTimesliceName)
+}
+
+func TestGetExclusiveDuration(t *testing.T) {
+	start := time.Unix(1000, 0)
+	span := ptrace.NewSpan()
+	setTestSpan(span, "parent", 1, 0, ptrace.SpanKindServer, start, start.Add(10*time.Second))
+	interval := func(from, to int) TimeInterval {
+		return TimeInterval{Start: pcommon.NewTimestampFromTime(start.Add(time.Duration(from) * time.Second)),
+			End: pcommon.NewTimestampFromTime(start.Add(time.Duration(to) * time.Second))}
+	}
+
+	tests := []struct {
+		name     string
+		children []TimeInterval
+		expected time.Duration
+	}{
+		{name: "no children", expected: 10 * time.Second},
+		{name: "sequential", children: []TimeInterval{interval(0, 2), interval(3, 5)}, expected: 6 * time.Second},
+		{name: "concurrent", children: []TimeInterval{interval(4, 8), interval(1, 5), interval(2, 3)}, expected: 3 * time.Second},
+		{name: "async after the end", children: []TimeInterval{interval(8, 15)}, expected: 8 * time.Second},
+		{name: "before the start", children: []TimeInterval{interval(-5, 1)}, expected: 9 * time.Second},
+		{name: "whole span", children: []TimeInterval{interval(0, 10), interval(0, 10)}, expected: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected.Nanoseconds(), GetExclusiveDuration(span, test.children))
+		})
+	}
+}
+
+func TestConcurrentChildSpansExclusiveTime(t *testing.T) {
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
+	metricMap := NewMetrics()
+	resources := pcommon.NewMap()
+	metrics := metricMap.GetOrCreateResource(resources)
+	start := time.Unix(1000, 0)
+
+	root := ptrace.NewSpan()
+	setTestSpan(root, "GET /", 1, 0, ptrace.SpanKindServer, start, start.Add(10*time.Second))
+	handler := ptrace.NewSpan()
+	setTestSpan(handler, "handler", 2, 1, ptrace.SpanKindInternal, start.Add(time.Second), start.Add(7*time.Second))
+	// fan-out calls, the first one is added before its parent
+	first := ptrace.NewSpan()
+	setTestSpan(first, "GET /users", 3, 2, ptrace.SpanKindClient, start.Add(2*time.Second), start.Add(5*time.Second))
+	first.Attributes().PutStr("server.address", "users")
+	second := ptrace.NewSpan()
+	setTestSpan(second, "GET /orders", 4, 2, ptrace.SpanKindClient, start.Add(3*time.Second), start.Add(6*time.Second))
+	second.Attributes().PutStr("server.address", "orders")
+
+	transaction, _ := transactions.GetOrCreateTransaction("java", root, metrics, resources)
+	for _, span := range []ptrace.Span{first, root, handler, second} {
+		transaction.AddSpan(span)
+	}
+	transaction.ProcessRootSpan()
+
+	assert.Equal(t, (2 * time.Second).Nanoseconds(), transaction.Measurements[handler.SpanID().String()].ExclusiveDurationNanos)
+	assert.Equal(t, (3 * time.Second).Nanoseconds(), transaction.Measurements[first.SpanID().String()].ExclusiveDurationNanos)
+	assert.Equal(t, (4 * time.Second).Nanoseconds(), transaction.RootExclusiveTime())
+}
+
+func TestSplitByEntrySpan(t *testing.T) {
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
+	metricMap := NewMetrics()
+	resources := pcommon.NewMap()
+	metrics := metricMap.GetOrCreateResource(resources)
+	start := time.Unix(1000, 0)
+
+	server := ptrace.NewSpan()
+	setTestSpan(server, "GET /orders", 1, 0, ptrace.SpanKindServer, start, start.Add(2*time.Second))
+	producer := ptrace.NewSpan()
+	setTestSpan(producer, "orders publish", 2, 1, ptrace.SpanKindProducer, start, start.Add(time.Second))
+	// the service consumes the message it published
+	consumer := ptrace.NewSpan()
+	setTestSpan(consumer, "orders process", 3, 2, ptrace.SpanKindConsumer, start.Add(3*time.Second), start.Add(5*time.Second))
+	client := ptrace.NewSpan()
+	setTestSpan(client, "POST /charge", 4, 3, ptrace.SpanKindClient, start.Add(3*time.Second), start.Add(4*time.Second))
+	client.Attributes().PutStr("server.address", "payments")
+	// without entry ancestor, the span belongs to the first transaction
+	orphan := ptrace.NewSpan()
+	setTestSpan(orphan, "cleanup", 5, 9, ptrace.SpanKindInternal, start, start.Add(time.Second))
+
+	transaction, _ := transactions.GetOrCreateTransaction("java", server, metrics, resources)
+	for _, span := range []ptrace.Span{client, server, producer, consumer, orphan} {
+		transaction.AddSpan(span)
+	}
+
+	split := transaction.SplitByEntrySpan()
+	assert.Equal(t, 2, len(split))
+	assert.Equal(t, server.SpanID(), split[0].RootSpan.SpanID())
+	assert.Equal(t, []ptrace.Span{server, producer, orphan}, split[0].spans)
+	assert.Equal(t, consumer.SpanID(), split[1].RootSpan.SpanID())
+	assert.Equal(t, []ptrace.Span{client, consumer}, split[1].spans)
+	// the measurements of the spans are only built for the transaction they belong to
+	assert.NotContains(t, split[0].Measurements, client.SpanID().String())
+	assert.Contains(t, split[1].Measurements, client.SpanID().String())
+	assert.Empty(t, transaction.Measurements)
+
+	single := NewTransactionsMap(&Config{ApdexT: 0.5})
+	transaction, _ = single.GetOrCreateTransaction("java", server, metrics, resources)
+	transaction.AddSpan(server)
+	transaction.AddSpan(producer)
+	assert.Equal(t, []*Transaction{transaction}, transaction.SplitByEntrySpan())
+}
+
+func TestNestedServerSpans(t *testing.T) {
+	transactions := NewTransactionsMap(&Config{ApdexT: 0.5})
+	metricMap := NewMetrics()
+	resources := pcommon.NewMap()
+	metrics := metricMap.GetOrCreateResource(resources)
+	start := time.Unix(1000, 0)
+
+	servlet := ptrace.NewSpan()
+	setTestSpan(servlet, "GET", 1, 0, ptrace.SpanKindServer, start, start.Add(10*time.Second))
+	filter := ptrace.NewSpan()
+	setTestSpan(filter, "filter", 2, 1, ptrace.SpanKindInternal, start.Add(time.Second), start.Add(9*time.Second))
+	controller := ptrace.NewSpan()
+	setTestSpan(controller, "GET /users/{id}", 3, 2, ptrace.SpanKindServer, start.Add(2*time.Second), start.Add(8*time.Second))
+	controller.Attributes().PutStr("http.request.method", "GET")
+	controller.Attributes().PutStr("http.route", "/users/{id}")
+	client := ptrace.NewSpan()
+	setTestSpan(client, "GET /accounts", 4, 3, ptrace.SpanKindClient, start.Add(3*time.Second), start.Add(5*time.Second))
+	client.Attributes().PutStr("server.address", "accounts")
+
+	// the inner server span is seen first
+	transaction, _ := transactions.GetOrCreateTransaction("java", controller, metrics, resources)
+	for _, span := range []ptrace.Span{controller, client, filter, servlet} {
+		transaction.AddSpan(span)
+	}
+
+	split := transaction.SplitByEntrySpan()
+	assert.Equal(t, []*Transaction{transaction}, split)
+	assert.Equal(t, servlet.SpanID(), transaction.RootSpan.SpanID())
+	transaction.ProcessRootSpan()
+
+	// the time of the controller span is part of the filter span, not counted twice
+	assert.Equal(t, (6 * time.Second).Nanoseconds(), transaction.Measurements[filter.SpanID().String()].ExclusiveDurationNanos)
+	assert.Equal(t, (2 * time.Second).Nanoseconds(), transaction.RootExclusiveTime())
+	durations := findMetric(t, "apm.service.transaction.sampled_duration", getAllMetrics(metricMap.AppendOtelMetrics(pmetric.NewMetrics())))
+	dp := durations.ExponentialHistogram().DataPoints().At(0)
+	name, _ := dp.Attributes().Get("transactionName")
+	assert.Equal(t, "WebTransaction/http.route/users/{id} (GET)", name.Str())
+	assert.Equal(t, 10.0, dp.Sum())
+}
+
+func TestForEachAncestor(t *testing.T) {
+	spanParents := map[string]string{"d": "c", "c": "b", "b": "a", "a": "c"}
+	getParentID := func(spanID string) (string, bool) {
+		parentID, exists := spanParents[spanID]
+		return parentID, exists
+	}
+	var ancestors []string
+	forEachAncestor("d", getParentID, func(ancestorID string) bool {
+		ancestors = append(ancestors, ancestorID)
+		return true
+	})
+	// the walk ends once it comes back to c
+	assert.Equal(t, []string{"c", "b", "a"}, ancestors)
+
+	ancestors = nil
+	forEachAncestor("d", getParentID, func(ancestorID string) bool {
+		ancestors = append(ancestors, ancestorID)
+		return ancestorID != "b"
+	})
+	assert.Equal(t, []string{"c", "b"}, ancestors)
+
+	// server spans whose parents form a cycle
+	start := time.Unix(1000, 0)
+	first := ptrace.NewSpan()
+	setTestSpan(first, "GET", 1, 2, ptrace.SpanKindServer, start, start.Add(time.Second))
+	second := ptrace.NewSpan()
+	setTestSpan(second, "GET", 2, 1, ptrace.SpanKindServer, start, start.Add(time.Second))
+	spansByID := map[string]ptrace.Span{first.SpanID().String(): first, second.SpanID().String(): second}
+	assert.True(t, isNestedServerSpan(first, spansByID))
+	entrySpanID, found := getEntrySpanID(first, spansByID, map[string]bool{first.SpanID().String(): true, second.SpanID().String(): true})
+	assert.False(t, found)
+	assert.Equal(t, "", entrySpanID)
+}
+
+func TestBackgroundTransactions(t *testing.T) {
+	start := time.Unix(1000, 0)
+	traces := newTestTraces()
+	scopeSpans := traces.ResourceSpans().At(0).ScopeSpans().At(0)
+	scopeSpans.Scope().SetName("io.opentelemetry.spring-scheduling-3.1")
+	setTestSpan(scopeSpans.Spans().AppendEmpty(), "ReportJob.run", 1, 0, ptrace.SpanKindInternal, start, start.Add(3*time.Second))
+	query := scopeSpans.Spans().AppendEmpty()
+	setTestSpan(query, "SELECT orders", 2, 1, ptrace.SpanKindClient, start.Add(time.Second), start.Add(2*time.Second))
+	query.Attributes().PutStr("db.system", "postgresql")
+	query.Attributes().PutStr("db.operation", "SELECT")
+	query.Attributes().PutStr("db.sql.table", "orders")
+
+	metrics := ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5}, traces)
+
+	durations := findMetric(t, "apm.service.transaction.duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+	assert.Equal(t, 1, durations.Len())
+	name, _ := durations.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "OtherTransaction/Custom/io.opentelemetry.spring-scheduling-3.1/ReportJob.run", name.Str())
+	transactionType, _ := durations.At(0).Attributes().Get("transactionType")
+	assert.Equal(t, "Other", transactionType.Str())
+	findMetric(t, "apm.service.datastore.operation.duration", getAllMetrics(metrics))
+	findMetric(t, "apm.service.overview.other", getAllMetrics(metrics))
+
+	metrics = ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5, BackgroundTransactions: BackgroundTransactionsConfig{Name: "OtherTransaction/Job/{span}"}}, traces)
+	durations = findMetric(t, "apm.service.transaction.duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+	name, _ = durations.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, "OtherTransaction/Job/ReportJob.run", name.Str())
+}
+
+func TestBackgroundTransactionConsumingMessages(t *testing.T) {
+	start := time.Unix(1000, 0)
+	traces := newTestTraces()
+	scopeSpans := traces.ResourceSpans().At(0).ScopeSpans().At(0)
+	scopeSpans.Scope().SetName("io.opentelemetry.spring-scheduling-3.1")
+	job := scopeSpans.Spans().AppendEmpty()
+	setTestSpan(job, "PollJob.run", 1, 0, ptrace.SpanKindInternal, start, start.Add(10*time.Second))
+	setTestSpan(scopeSpans.Spans().AppendEmpty(), "orders process", 2, 1, ptrace.SpanKindConsumer, start.Add(time.Second), start.Add(2*time.Second))
+	setTestSpan(scopeSpans.Spans().AppendEmpty(), "orders process", 3, 1, ptrace.SpanKindConsumer, start.Add(3*time.Second), start.Add(4*time.Second))
+
+	metrics := ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5}, traces)
+
+	// the job and each message it consumes are transactions of their own
+	durations := findMetric(t, "apm.service.transaction.sampled_duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+	assert.Equal(t, 2, durations.Len())
+	sums := make(map[string]float64)
+	counts := make(map[string]uint64)
+	for i := 0; i < durations.Len(); i++ {
+		name, _ := durations.At(i).Attributes().Get("transactionName")
+		sums[name.Str()] = durations.At(i).Sum()
+		counts[name.Str()] = durations.At(i).Count()
+	}
+	jobName := "OtherTransaction/Custom/io.opentelemetry.spring-scheduling-3.1/PollJob.run"
+	assert.Equal(t, 10.0, sums[jobName])
+	assert.Equal(t, uint64(1), counts[jobName])
+	assert.Equal(t, 2.0, sums["OtherTransaction/Consumer/unknownSystem/unknown/unknown"])
+	assert.Equal(t, uint64(2), counts["OtherTransaction/Consumer/unknownSystem/unknown/unknown"])
+	// only the job has its duration derived from the spans
+	durations = findMetric(t, "apm.service.transaction.duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+	assert.Equal(t, 1, durations.Len())
+	name, _ := durations.At(0).Attributes().Get("transactionName")
+	assert.Equal(t, jobName, name.Str())
+}
+
+func TestOrphanSpans(t *testing.T) {
+	start := time.Unix(1000, 0)
+	traces := newTestTraces()
+	spans := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans()
+	// the root span, 1, was never seen
+	setTestSpan(spans.AppendEmpty(), "handler", 2, 1, ptrace.SpanKindInternal, start, start.Add(3*time.Second))
+	query := spans.AppendEmpty()
+	setTestSpan(query, "SELECT orders", 3, 2, ptrace.SpanKindClient, start.Add(time.Second), start.Add(2*time.Second))
+	query.Attributes().PutStr("db.system", "postgresql")
+	query.Attributes().PutStr("db.operation", "SELECT")
+	query.Attributes().PutStr("db.sql.table", "orders")
+
+	metrics := ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5}, traces)
+	checkSumMetric(t, orphanTransactionMetricName, 1, getAllMetrics(metrics))
+	checkSumMetric(t, orphanSpanMetricName, 2, getAllMetrics(metrics))
+	checkNoMetric(t, "apm.service.datastore.operation.duration", getAllMetrics(metrics))
+
+	metrics = ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5, OrphanSpans: OrphanSpansConfig{Enabled: true}}, traces)
+	datastore := findMetric(t, "apm.service.datastore.operation.duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+	assert.Equal(t, 1, datastore.Len())
+	scope, _ := datastore.At(0).Attributes().Get("scope")
+	assert.Equal(t, "WebTransaction/Other/Unknown", scope.Str())
+	checkNoMetric(t, "newrelic.timeslice.value", getAllMetrics(metrics))
+
+	// a parentless client span does not start a transaction
+	traces = newTestTraces()
+	call := traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().AppendEmpty()
+	setTestSpan(call, "GET /orders", 1, 0, ptrace.SpanKindClient, start, start.Add(time.Second))
+	call.Attributes().PutStr("server.address", "orders.example.com")
+	metrics = ConvertTraces(zap.NewNop(), &Config{ApdexT: 0.5, OrphanSpans: OrphanSpansConfig{Enabled: true}}, traces)
+	checkSumMetric(t, orphanTransactionMetricName, 1, getAllMetrics(metrics))
+	checkSumMetric(t, orphanSpanMetricName, 1, getAllMetrics(metrics))
+	external := findMetric(t, "apm.service.transaction.external.host.duration", getAllMetrics(metrics)).ExponentialHistogram().DataPoints()
+	assert.Equal(t, 1, external.Len())
+
+	assert.NoError(t, (&Config{OrphanSpans: OrphanSpansConfig{Enabled: true, TransactionName: "OtherTransaction/Other/Unknown"}}).Validate())
+	assert.Error(t, (&Config{OrphanSpans: OrphanSpansConfig{Enabled: true, TransactionName: "Unknown"}}).Validate())
+}
@@ -0,0 +1,110 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector // import "github.com/newrelic/opentelemetry-collector-components/connector/apmconnector"
+
+import (
+	"regexp"
+	"strings"
+)
+
+// replaces the path segments identifying resources, and the segments not in an allow-list
+const normalizedSegment = "*"
+
+var (
+	uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	// long enough not to match words, such as `cafe`
+	hexSegment = regexp.MustCompile(`^[0-9a-fA-F]{8,}$`)
+)
+
+var defaultURLNormalizer = NewURLNormalizer(URLNormalizationConfig{})
+
+// URLNormalizer turns URL paths into transaction names of bounded cardinality. The rewrite rules are applied
+// first, then the default rules replacing numeric, UUID and hexadecimal segments, then the segment terms.
+type URLNormalizer struct {
+	defaultRules bool
+	rules        []urlRewriteRule
+	segmentTerms []segmentTerms
+}
+
+type urlRewriteRule struct {
+	match       *regexp.Regexp
+	replacement string
+}
+
+type segmentTerms struct {
+	prefix string
+	terms  map[string]bool
+}
+
+func NewURLNormalizer(config URLNormalizationConfig) *URLNormalizer {
+	normalizer := &URLNormalizer{defaultRules: !config.DisableDefaultRules}
+	for _, rule := range config.Rules {
+		// rules are validated with the configuration
+		if match, err := regexp.Compile(rule.Match); err == nil {
+			normalizer.rules = append(normalizer.rules, urlRewriteRule{match: match, replacement: rule.Replacement})
+		}
+	}
+	for _, rule := range config.SegmentTerms {
+		terms := make(map[string]bool, len(rule.Terms))
+		for _, term := range rule.Terms {
+			terms[term] = true
+		}
+		normalizer.segmentTerms = append(normalizer.segmentTerms, segmentTerms{prefix: strings.TrimSuffix(rule.Prefix, "/"), terms: terms})
+	}
+	return normalizer
+}
+
+// Normalize returns the path without its query string, rewritten by the rules.
+func (normalizer *URLNormalizer) Normalize(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	for _, rule := range normalizer.rules {
+		path = rule.match.ReplaceAllString(path, rule.replacement)
+	}
+	if normalizer.defaultRules {
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			if isIdentifierSegment(segment) {
+				segments[i] = normalizedSegment
+			}
+		}
+		path = strings.Join(segments, "/")
+	}
+	for _, rule := range normalizer.segmentTerms {
+		if path != rule.prefix && !strings.HasPrefix(path, rule.prefix+"/") {
+			continue
+		}
+		path = rule.prefix + rule.apply(path[len(rule.prefix):])
+		// only the first matching prefix applies
+		break
+	}
+	return path
+}
+
+// apply replaces the segments not in the terms, consecutive replaced segments are collapsed into one.
+func (rule segmentTerms) apply(path string) string {
+	segments := strings.Split(path, "/")
+	kept := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		if i == 0 || segment == "" || rule.terms[segment] {
+			kept = append(kept, segment)
+		} else if kept[len(kept)-1] != normalizedSegment {
+			kept = append(kept, normalizedSegment)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+func isIdentifierSegment(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	if strings.Trim(segment, "0123456789") == "" {
+		return true
+	}
+	if uuidSegment.MatchString(segment) {
+		return true
+	}
+	// hexadecimal segments must contain a digit, so that words are kept
+	return hexSegment.MatchString(segment) && strings.ContainsAny(segment, "0123456789")
+}
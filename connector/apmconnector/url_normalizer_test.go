@@ -0,0 +1,56 @@
+// Copyright New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apmconnector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURLNormalizerDefaultRules(t *testing.T) {
+	normalizer := NewURLNormalizer(URLNormalizationConfig{})
+	var tests = []struct {
+		path       string
+		normalized string
+	}{
+		{"/users/83412", "/users/*"},
+		{"/users/83412/orders/12", "/users/*/orders/*"},
+		{"/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "/orders/*"},
+		{"/commits/5f1e2d3c4b5a69788796a5b4c3d2e1f0a9b8c7d6", "/commits/*"},
+		{"/objects/507F1F77BCF86CD799439011/", "/objects/*/"},
+		{"/search?q=1234", "/search"},
+		{"/v1/facade/deadbeef", "/v1/facade/deadbeef"},
+		{"/", "/"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.normalized, normalizer.Normalize(tt.path), tt.path)
+	}
+}
+
+func TestURLNormalizerRules(t *testing.T) {
+	normalizer := NewURLNormalizer(URLNormalizationConfig{
+		DisableDefaultRules: true,
+		Rules: []URLRewriteRule{
+			{Match: `^/static/.*`, Replacement: "/static/*"},
+			{Match: `/users/([^/]+)@[^/]+`, Replacement: "/users/$1@*"},
+		},
+	})
+	assert.Equal(t, "/static/*", normalizer.Normalize("/static/js/app.12ab34cd.js"))
+	assert.Equal(t, "/users/jane@*/profile", normalizer.Normalize("/users/jane@example.com/profile"))
+	assert.Equal(t, "/users/83412", normalizer.Normalize("/users/83412"))
+}
+
+func TestURLNormalizerSegmentTerms(t *testing.T) {
+	normalizer := NewURLNormalizer(URLNormalizationConfig{
+		SegmentTerms: []SegmentTermsRule{
+			{Prefix: "/api/", Terms: []string{"users", "orders", "v2"}},
+		},
+	})
+	assert.Equal(t, "/api/v2/users/*", normalizer.Normalize("/api/v2/users/jane"))
+	assert.Equal(t, "/api/*/orders", normalizer.Normalize("/api/acme/eu-west/orders"))
+	assert.Equal(t, "/api/users/*/orders", normalizer.Normalize("/api/users/42/orders"))
+	assert.Equal(t, "/api", normalizer.Normalize("/api"))
+	assert.Equal(t, "/apis/jane", normalizer.Normalize("/apis/jane"))
+}